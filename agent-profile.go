@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// perMessageProfileKey is the unstable key for per-message profiles
+// (MSC4144), which lets clients show the agent instead of the bot user.
+const perMessageProfileKey = "com.beeper.per_message_profile"
+
+type perMessageProfile struct {
+	ID          string              `json:"id"`
+	Displayname string              `json:"displayname,omitempty"`
+	AvatarURL   id.ContentURIString `json:"avatar_url,omitempty"`
+	HasFallback bool                `json:"has_fallback"`
+}
+
+const (
+	// avatarRetryInterval is how long to wait before trying to download an
+	// avatar again after it failed.
+	avatarRetryInterval = 15 * time.Minute
+	maxAvatarSize       = 10 * 1024 * 1024
+)
+
+// avatarHTTPClient downloads the avatars, which may be hosted anywhere, so
+// slow hosts must not hold up the messages of the agent for long.
+var avatarHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// agentAvatarLocks makes sure that the avatar of each agent is only uploaded
+// once even if multiple messages from the agent are handled concurrently.
+// Every agent has their own lock so that a slow avatar doesn't hold up the
+// messages of other agents.
+var agentAvatarLocks = map[string]*sync.Mutex{}
+var agentAvatarLocksLock sync.Mutex
+
+type avatarFailure struct {
+	avatarURL string
+	failedAt  time.Time
+}
+
+// agentAvatarFailures remembers the avatars that couldn't be downloaded or
+// uploaded so that they aren't retried for every message. It is protected by
+// the lock of the agent.
+var agentAvatarFailures = map[string]avatarFailure{}
+
+func agentAvatarLock(agentKey string) *sync.Mutex {
+	agentAvatarLocksLock.Lock()
+	defer agentAvatarLocksLock.Unlock()
+	lock, found := agentAvatarLocks[agentKey]
+	if !found {
+		lock = &sync.Mutex{}
+		agentAvatarLocks[agentKey] = lock
+	}
+	return lock
+}
+
+// usePerMessageProfile returns whether messages from the sender should be
+// sent with a per-message profile. Only agents and agent bots get profiles.
+func usePerMessageProfile(sender chatwootapi.Sender) bool {
+	if !configuration.PerMessageProfiles {
+		return false
+	}
+	senderType := sender.GetType()
+	return senderType == chatwootapi.SenderTypeUser || senderType == chatwootapi.SenderTypeAgentBot
+}
+
+// getPerMessageProfile returns the per-message profile to send with messages
+// from the sender, or nil if the sender shouldn't get a profile.
+func getPerMessageProfile(ctx context.Context, sender chatwootapi.Sender) *perMessageProfile {
+	if !usePerMessageProfile(sender) {
+		return nil
+	}
+	return &perMessageProfile{
+		ID:          fmt.Sprintf("%s-%d", sender.GetType(), sender.ID),
+		Displayname: sender.DisplayName(),
+		AvatarURL:   getAgentAvatar(ctx, sender),
+	}
+}
+
+// getAgentAvatar returns the Matrix media of the sender's avatar. The avatar
+// is only uploaded again if the avatar URL in Chatwoot changed.
+func getAgentAvatar(ctx context.Context, sender chatwootapi.Sender) id.ContentURIString {
+	avatarURL := sender.Thumbnail
+	if avatarURL == "" {
+		avatarURL = sender.AvatarURL
+	}
+	if avatarURL == "" {
+		return ""
+	}
+	log := zerolog.Ctx(ctx).With().
+		Str("sender_type", string(sender.GetType())).
+		Int("sender_id", sender.ID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	agentKey := fmt.Sprintf("%s-%d", sender.GetType(), sender.ID)
+	lock := agentAvatarLock(agentKey)
+	lock.Lock()
+	defer lock.Unlock()
+
+	cachedURL, mxc, err := stateStore.GetAgentAvatar(ctx, string(sender.GetType()), sender.ID)
+	if err == nil && cachedURL == avatarURL {
+		return mxc
+	} else if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Warn().Err(err).Msg("failed to get cached agent avatar")
+	}
+	if failure, found := agentAvatarFailures[agentKey]; found &&
+		failure.avatarURL == avatarURL && time.Since(failure.failedAt) < avatarRetryInterval {
+		// Keep using the previous avatar until it's time to try again.
+		return mxc
+	}
+
+	data, err := DoRetryArr(ctx, "download agent avatar", func(ctx context.Context) ([]byte, error) {
+		return downloadAvatar(ctx, avatarURL)
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to download agent avatar")
+		agentAvatarFailures[agentKey] = avatarFailure{avatarURL: avatarURL, failedAt: time.Now()}
+		return mxc
+	}
+	uploaded, err := DoRetry(ctx, "upload agent avatar to Matrix", func(context.Context) (*mautrix.RespMediaUpload, error) {
+		return client.UploadMedia(mautrix.ReqUploadMedia{
+			ContentBytes:  data,
+			ContentLength: int64(len(data)),
+			ContentType:   http.DetectContentType(data),
+		})
+	})
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to upload agent avatar")
+		agentAvatarFailures[agentKey] = avatarFailure{avatarURL: avatarURL, failedAt: time.Now()}
+		return mxc
+	}
+	delete(agentAvatarFailures, agentKey)
+	mxc = uploaded.ContentURI.CUString()
+	log.Info().Str("mxc", string(mxc)).Msg("uploaded agent avatar")
+
+	if err = stateStore.SetAgentAvatar(ctx, string(sender.GetType()), sender.ID, avatarURL, mxc); err != nil {
+		log.Warn().Err(err).Msg("failed to cache agent avatar")
+	}
+	return mxc
+}
+
+// downloadAvatar downloads an avatar. Avatars may be hosted outside of
+// Chatwoot (for example on Gravatar), so the Chatwoot access token is not
+// sent with the request.
+func downloadAvatar(ctx context.Context, avatarURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, avatarURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := avatarHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected status code %d downloading avatar", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxAvatarSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > maxAvatarSize {
+		return nil, fmt.Errorf("avatar is larger than %d bytes", maxAvatarSize)
+	}
+	return data, nil
+}
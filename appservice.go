@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v2"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+	"maunium.net/go/mautrix/sqlstatestore"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// appService is only set when the bot runs in appservice mode.
+var appService *appservice.AppService
+
+type ghostProfile struct {
+	Displayname string
+	AvatarURL   id.ContentURIString
+}
+
+// ghostProfiles keeps track of the profiles that were set on the ghost users
+// so that the profile is only updated when it changes in Chatwoot.
+var ghostProfiles = map[id.UserID]ghostProfile{}
+var ghostProfilesLock sync.Mutex
+
+// appserviceRegistration adds the MSC3202 flag to the registration, which
+// makes the homeserver send the to-device events and one-time key counts of
+// the bot's device in transactions.
+type appserviceRegistration struct {
+	appservice.Registration `yaml:",inline"`
+	MSC3202                 bool `yaml:"org.matrix.msc3202"`
+}
+
+// ghostUserRegex matches all of the ghost users of Chatwoot agents.
+func ghostUserRegex() *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf("^@%s.+:%s$",
+		regexp.QuoteMeta(configuration.Appservice.GhostLocalpartPrefix),
+		regexp.QuoteMeta(configuration.Username.Homeserver())))
+}
+
+// generateRegistration writes a new registration file that has to be added to
+// the homeserver configuration.
+func generateRegistration(path string) error {
+	localpart, _, err := configuration.Username.Parse()
+	if err != nil {
+		return fmt.Errorf("failed to parse the bot username: %w", err)
+	}
+	registration := appservice.CreateRegistration()
+	registration.ID = configuration.Appservice.ID
+	registration.URL = configuration.Appservice.Address
+	registration.SenderLocalpart = localpart
+	rateLimited := false
+	registration.RateLimited = &rateLimited
+	registration.Namespaces.UserIDs.Register(ghostUserRegex(), true)
+	registration.EphemeralEvents = true
+	registration.SoruEphemeralEvents = true
+
+	data, err := yaml.Marshal(appserviceRegistration{Registration: *registration, MSC3202: true})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// newAppservice creates the appservice from the registration file. The bot
+// user is the sender of the appservice, so the access token of the client is
+// replaced with the appservice token.
+func newAppservice(log *zerolog.Logger) (*appservice.AppService, error) {
+	registration, err := appservice.LoadRegistration(configuration.Appservice.RegistrationFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load registration: %w", err)
+	}
+	localpart, homeserver, err := configuration.Username.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the bot username: %w", err)
+	} else if registration.SenderLocalpart != localpart {
+		return nil, fmt.Errorf("registration sender_localpart %q doesn't match the bot username", registration.SenderLocalpart)
+	}
+
+	as := appservice.Create()
+	as.Log = log.With().Str("component", "appservice").Logger()
+	as.Registration = registration
+	as.HomeserverDomain = homeserver
+	as.Host.Hostname = configuration.Appservice.Hostname
+	as.Host.Port = configuration.Appservice.Port
+	if err = as.SetHomeserverURL(configuration.Homeserver); err != nil {
+		return nil, fmt.Errorf("invalid homeserver URL: %w", err)
+	}
+	sqlStateStore, ok := client.StateStore.(*sqlstatestore.SQLStateStore)
+	if !ok {
+		return nil, fmt.Errorf("the client state store is not an SQL state store")
+	}
+	as.StateStore = sqlStateStore
+	return as, nil
+}
+
+// dispatchAppserviceEvents passes the events from appservice transactions to
+// the syncer handlers so that they are handled the same way as synced events.
+func dispatchAppserviceEvents(ep *appservice.EventProcessor, syncer *mautrix.DefaultSyncer) {
+	timelineTypes := []event.Type{
+		event.EventMessage,
+		event.EventSticker,
+		event.EventReaction,
+		event.EventRedaction,
+		event.EventEncrypted,
+		event.StateMember,
+		event.StateEncryption,
+		event.StatePowerLevels,
+	}
+	timelineTypes = append(timelineTypes, pollEventTypes...)
+	for _, evtType := range timelineTypes {
+		ep.On(evtType, func(evt *event.Event) {
+			syncer.Dispatch(mautrix.EventSourceJoin|mautrix.EventSourceTimeline, evt)
+		})
+	}
+	for _, evtType := range []event.Type{event.EphemeralEventTyping, event.EphemeralEventReceipt} {
+		ep.On(evtType, func(evt *event.Event) {
+			syncer.Dispatch(mautrix.EventSourceJoin|mautrix.EventSourceEphemeral, evt)
+		})
+	}
+}
+
+// ghostUserID returns the ghost user of the sender. Only agents and agent
+// bots have ghost users.
+func ghostUserID(sender chatwootapi.Sender) (id.UserID, bool) {
+	var localpart string
+	switch sender.GetType() {
+	case chatwootapi.SenderTypeUser:
+		localpart = fmt.Sprintf("%s%d", configuration.Appservice.GhostLocalpartPrefix, sender.ID)
+	case chatwootapi.SenderTypeAgentBot:
+		localpart = fmt.Sprintf("%sbot_%d", configuration.Appservice.GhostLocalpartPrefix, sender.ID)
+	default:
+		return "", false
+	}
+	return id.NewUserID(localpart, botHomeserver), true
+}
+
+// isGhostUser returns whether the user is the ghost user of a Chatwoot agent.
+func isGhostUser(userID id.UserID) bool {
+	if appService == nil {
+		return false
+	}
+	localpart, homeserver, err := userID.Parse()
+	return err == nil && homeserver == botHomeserver &&
+		strings.HasPrefix(localpart, configuration.Appservice.GhostLocalpartPrefix)
+}
+
+// isBridgeUser returns whether the user is the bot or one of its ghosts, in
+// which case the user's events came from Chatwoot.
+func isBridgeUser(userID id.UserID) bool {
+	return userID == configuration.Username || isGhostUser(userID)
+}
+
+// senderClient returns the client to send the messages of the Chatwoot sender
+// with. In appservice mode, agents send messages through their ghost user,
+// otherwise (or if the ghost can't join the room) the bot sends the messages.
+//
+// The ghosts don't have devices of their own, and encrypting their messages
+// with the bot's device would make clients flag them as untrusted, so the bot
+// sends the messages in encrypted rooms.
+func senderClient(ctx context.Context, roomID id.RoomID, sender chatwootapi.Sender) *mautrix.Client {
+	if appService == nil {
+		return client
+	}
+	userID, ok := ghostUserID(sender)
+	if !ok {
+		return client
+	}
+	log := zerolog.Ctx(ctx).With().Str("ghost_user_id", userID.String()).Logger()
+
+	if client.StateStore.IsEncrypted(roomID) {
+		log.Debug().Msg("room is encrypted, sending as the bot")
+		return client
+	}
+	intent := appService.Intent(userID)
+	if err := intent.EnsureRegistered(); err != nil {
+		log.Err(err).Msg("failed to register ghost user, sending as the bot")
+		return client
+	}
+	updateGhostProfile(log.WithContext(ctx), intent, sender)
+	// The bot owns the room, so it invites the ghost if necessary.
+	if err := intent.EnsureJoined(roomID, appservice.EnsureJoinedParams{BotOverride: client}); err != nil {
+		log.Err(err).Msg("failed to join ghost user to room, sending as the bot")
+		return client
+	}
+	return intent.Client
+}
+
+// updateGhostProfile sets the name and avatar of the ghost user to the ones
+// of the agent in Chatwoot.
+func updateGhostProfile(ctx context.Context, intent *appservice.IntentAPI, sender chatwootapi.Sender) {
+	log := zerolog.Ctx(ctx)
+
+	profile := ghostProfile{
+		Displayname: sender.DisplayName(),
+		AvatarURL:   getAgentAvatar(ctx, sender),
+	}
+	ghostProfilesLock.Lock()
+	defer ghostProfilesLock.Unlock()
+	current := ghostProfiles[intent.UserID]
+	if current == profile {
+		return
+	}
+
+	if profile.Displayname != current.Displayname {
+		if err := intent.SetDisplayName(profile.Displayname); err != nil {
+			log.Warn().Err(err).Msg("failed to set ghost display name")
+			return
+		}
+	}
+	if profile.AvatarURL != current.AvatarURL {
+		avatarURL, err := profile.AvatarURL.Parse()
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to parse agent avatar URL")
+			return
+		} else if err = intent.SetAvatarURL(avatarURL); err != nil {
+			log.Warn().Err(err).Msg("failed to set ghost avatar")
+			return
+		}
+	}
+	ghostProfiles[intent.UserID] = profile
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/renderer"
+	goldmarkhtml "github.com/yuin/goldmark/renderer/html"
+	"github.com/yuin/goldmark/util"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/format/mdext"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+var (
+	// Chatwoot mentions look like [@Agent Name](mention://user/1/Agent%20Name)
+	chatwootMentionRegex = regexp.MustCompile(`\[(@[^\]]+)\]\(mention://[^)]*\)`)
+	// Canned responses can contain variables like {{contact.name}} which
+	// Chatwoot doesn't always expand.
+	chatwootVariableRegex = regexp.MustCompile(`{{\s*([\w.]+)\s*}}`)
+	codeLanguageRegex     = regexp.MustCompile(`<code class="language-[^"]*">`)
+)
+
+// chatwootMarkdown renders Chatwoot markdown into the HTML subset supported by
+// Matrix. Raw HTML is escaped, dangerous links are replaced with their text
+// and images are turned into links since Matrix only allows mxc:// images.
+var chatwootMarkdown = goldmark.New(
+	goldmark.WithExtensions(extension.Strikethrough, extension.Table, mdext.EscapeHTML, safeLinks),
+	goldmark.WithRendererOptions(goldmarkhtml.WithHardWraps()),
+)
+
+// safeURLSchemes are the URL schemes that links in Chatwoot messages may use.
+var safeURLSchemes = map[string]bool{
+	"http":   true,
+	"https":  true,
+	"mailto": true,
+	"tel":    true,
+	"matrix": true,
+}
+
+// isSafeURL returns whether the link destination has one of the allowed
+// schemes. An allowlist is used since schemes are case-insensitive and
+// browsers ignore some characters in them, which makes it hard to reliably
+// recognize dangerous schemes like javascript: and data:.
+func isSafeURL(destination []byte) bool {
+	scheme, _, found := strings.Cut(string(destination), ":")
+	return found && safeURLSchemes[strings.ToLower(scheme)]
+}
+
+type safeLinksRenderer struct{}
+
+var safeLinks = &safeLinksRenderer{}
+
+func (r *safeLinksRenderer) Extend(m goldmark.Markdown) {
+	m.Renderer().AddOptions(renderer.WithNodeRenderers(util.Prioritized(r, 0)))
+}
+
+func (r *safeLinksRenderer) RegisterFuncs(reg renderer.NodeRendererFuncRegisterer) {
+	reg.Register(ast.KindLink, r.renderLink)
+	reg.Register(ast.KindImage, r.renderImage)
+	reg.Register(ast.KindAutoLink, r.renderAutoLink)
+}
+
+func (r *safeLinksRenderer) renderLink(w util.BufWriter, _ []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	n := node.(*ast.Link)
+	if !isSafeURL(n.Destination) {
+		return ast.WalkContinue, nil
+	}
+	if entering {
+		_, _ = w.WriteString(`<a href="`)
+		_, _ = w.Write(util.EscapeHTML(util.URLEscape(n.Destination, true)))
+		_, _ = w.WriteString(`">`)
+	} else {
+		_, _ = w.WriteString(`</a>`)
+	}
+	return ast.WalkContinue, nil
+}
+
+func (r *safeLinksRenderer) renderAutoLink(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkContinue, nil
+	}
+	n := node.(*ast.AutoLink)
+	destination := n.URL(source)
+	if n.AutoLinkType == ast.AutoLinkEmail && !bytes.HasPrefix(bytes.ToLower(destination), []byte("mailto:")) {
+		destination = append([]byte("mailto:"), destination...)
+	}
+	label := n.Label(source)
+	if !isSafeURL(destination) {
+		_, _ = w.Write(util.EscapeHTML(label))
+		return ast.WalkContinue, nil
+	}
+	_, _ = w.WriteString(`<a href="`)
+	_, _ = w.Write(util.EscapeHTML(util.URLEscape(destination, false)))
+	_, _ = w.WriteString(`">`)
+	_, _ = w.Write(util.EscapeHTML(label))
+	_, _ = w.WriteString(`</a>`)
+	return ast.WalkContinue, nil
+}
+
+func (r *safeLinksRenderer) renderImage(w util.BufWriter, source []byte, node ast.Node, entering bool) (ast.WalkStatus, error) {
+	if !entering {
+		return ast.WalkSkipChildren, nil
+	}
+	n := node.(*ast.Image)
+	text := n.Text(source)
+	if len(text) == 0 {
+		text = n.Destination
+	}
+	if !isSafeURL(n.Destination) {
+		_, _ = w.Write(util.EscapeHTML(text))
+		return ast.WalkSkipChildren, nil
+	}
+	_, _ = w.WriteString(`<a href="`)
+	_, _ = w.Write(util.EscapeHTML(util.URLEscape(n.Destination, true)))
+	_, _ = w.WriteString(`">`)
+	_, _ = w.Write(util.EscapeHTML(text))
+	_, _ = w.WriteString(`</a>`)
+	return ast.WalkSkipChildren, nil
+}
+
+// chatwootTemplateVariables returns the values of the variables that can be
+// used in canned responses.
+func chatwootTemplateVariables(sender chatwootapi.Sender, conversation chatwootapi.Conversation) map[string]string {
+	contact := conversation.Meta.Sender
+	contactFirstName, contactLastName, _ := strings.Cut(contact.Name, " ")
+	agentName := sender.DisplayName()
+	agentFirstName, agentLastName, _ := strings.Cut(agentName, " ")
+	return map[string]string{
+		"contact.name":       contact.Name,
+		"contact.first_name": contactFirstName,
+		"contact.last_name":  contactLastName,
+		"contact.email":      contact.Email,
+		"contact.phone":      contact.PhoneNumber,
+		"agent.name":         agentName,
+		"agent.first_name":   agentFirstName,
+		"agent.last_name":    agentLastName,
+		"conversation.id":    strconv.Itoa(conversation.ID),
+	}
+}
+
+// escapeMarkdown escapes all ASCII punctuation, which CommonMark allows to be
+// escaped, so that the text is rendered literally.
+func escapeMarkdown(text string) string {
+	var escaped strings.Builder
+	for _, char := range text {
+		if char < 0x80 && (unicode.IsPunct(char) || unicode.IsSymbol(char)) {
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(char)
+	}
+	return escaped.String()
+}
+
+// expandChatwootSyntax expands the variables left in the message and turns
+// mentions into plain @names. Unknown variables are removed, the same way
+// Chatwoot does it. The variables and names come from contacts and agents, so
+// if the content is markdown, they are escaped to keep them from adding links
+// or other formatting.
+func expandChatwootSyntax(content string, variables map[string]string, markdown bool) string {
+	literal := func(text string) string {
+		if markdown {
+			return escapeMarkdown(text)
+		}
+		return text
+	}
+	content = chatwootVariableRegex.ReplaceAllStringFunc(content, func(match string) string {
+		return literal(variables[chatwootVariableRegex.FindStringSubmatch(match)[1]])
+	})
+	return chatwootMentionRegex.ReplaceAllStringFunc(content, func(match string) string {
+		return literal(chatwootMentionRegex.FindStringSubmatch(match)[1])
+	})
+}
+
+// messageAttribution is the text added to a message to show who sent it.
+type messageAttribution struct {
+	Prefix string
+	Suffix string
+	// ProfileFallback marks the attribution as a fallback for clients that
+	// don't support per-message profiles so that other clients can hide it.
+	ProfileFallback bool
+}
+
+func (a messageAttribution) IsEmpty() bool {
+	return a.Prefix == "" && a.Suffix == ""
+}
+
+func (a messageAttribution) formatHTML(text string) string {
+	escaped := html.EscapeString(text)
+	if a.ProfileFallback && text != "" {
+		return "<span data-mx-profile-fallback>" + escaped + "</span>"
+	}
+	return escaped
+}
+
+// renderChatwootMarkdown converts the content of a Chatwoot message into
+// Matrix message content. The attribution prefix and suffix are added as plain
+// text so that agent names are never interpreted as markdown.
+func renderChatwootMarkdown(content string, attribution messageAttribution, variables map[string]string, formatting FormattingConfiguration) event.MessageEventContent {
+	text := expandChatwootSyntax(content, variables, configuration.RenderMarkdown)
+
+	var htmlBody string
+	var hasFormatting bool
+	if configuration.RenderMarkdown {
+		var buf strings.Builder
+		if err := chatwootMarkdown.Convert([]byte(text), &buf); err == nil {
+			htmlBody = format.UnwrapSingleParagraph(buf.String())
+			if !formatting.CodeHighlighting {
+				htmlBody = codeLanguageRegex.ReplaceAllString(htmlBody, "<code>")
+			}
+			text = format.HTMLToText(htmlBody)
+			// Line breaks alone aren't worth sending the HTML for.
+			hasFormatting = strings.Contains(strings.ReplaceAll(htmlBody, "<br>", ""), "<")
+		}
+	}
+
+	body := attribution.Prefix + text + attribution.Suffix
+	// The attribution has to be marked in the HTML for clients to be able to
+	// hide it, so it is always sent if there is a profile fallback.
+	if !hasFormatting && (!attribution.ProfileFallback || attribution.IsEmpty()) {
+		return event.MessageEventContent{MsgType: event.MsgText, Body: body}
+	}
+	if !hasFormatting {
+		htmlBody = strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+	}
+
+	prefix := attribution.formatHTML(attribution.Prefix)
+	if strings.HasPrefix(htmlBody, "<p>") {
+		htmlBody = "<p>" + prefix + strings.TrimPrefix(htmlBody, "<p>")
+	} else {
+		htmlBody = prefix + htmlBody
+	}
+	suffix := attribution.formatHTML(attribution.Suffix)
+	if strings.HasSuffix(htmlBody, "</p>") {
+		htmlBody = strings.TrimSuffix(htmlBody, "</p>") + suffix + "</p>"
+	} else {
+		htmlBody += suffix
+	}
+	return event.MessageEventContent{
+		MsgType:       event.MsgText,
+		Body:          body,
+		Format:        event.FormatHTML,
+		FormattedBody: htmlBody,
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+var testFormatting = FormattingConfiguration{LinkPreviews: true, CodeHighlighting: true}
+
+// withRenderMarkdown sets whether markdown is rendered for the duration of
+// the test.
+func withRenderMarkdown(t *testing.T, renderMarkdown bool) {
+	previous := configuration.RenderMarkdown
+	configuration.RenderMarkdown = renderMarkdown
+	t.Cleanup(func() { configuration.RenderMarkdown = previous })
+}
+
+func TestRenderChatwootMarkdown(t *testing.T) {
+	withRenderMarkdown(t, true)
+
+	tests := []struct {
+		name          string
+		content       string
+		body          string
+		formattedBody string
+	}{
+		{"plain text", "hello", "hello", ""},
+		{"formatting", "**bold** and _italic_", "**bold** and _italic_", "<strong>bold</strong> and <em>italic</em>"},
+		{"code block", "```go\nx\n```", "```go\nx\n```", "<pre><code class=\"language-go\">x\n</code></pre>"},
+
+		{"script block", "<script>alert(1)</script>", "<script>alert(1)</script>", ""},
+		{"inline html", "hi <img src=x onerror=alert(1)> there", "hi <img src=x onerror=alert(1)> there", ""},
+		{"html link", `<a href="javascript:alert(1)">x</a>`, `<a href="javascript:alert(1)">x</a>`, ""},
+		{"html with formatting", "**hi** <b>x</b>", "**hi** <b>x</b>", "<strong>hi</strong> &lt;b&gt;x&lt;/b&gt;"},
+
+		{"https link", "[ok](https://example.com/?a=1&b=\"2\")", "ok (https://example.com/?a=1&b=%222%22)", `<a href="https://example.com/?a=1&amp;b=%222%22">ok</a>`},
+		{"mailto link", "[mail](mailto:help@example.com)", "mail (mailto:help@example.com)", `<a href="mailto:help@example.com">mail</a>`},
+		{"javascript link", "[x](javascript:alert(1))", "x", ""},
+		{"mixed case javascript link", "[x](JaVaScRiPt:alert(1))", "x", ""},
+		{"javascript link with entity", "[x](java&#x09;script:alert(1))", "x", ""},
+		{"data link", "[x](data:text/html;base64,PHNjcmlwdD4=)", "x", ""},
+		{"vbscript link", "[x](vbscript:msgbox)", "x", ""},
+		{"relative link", "[x](/admin)", "x", ""},
+		{"autolink", "<https://example.com>", "https://example.com", `<a href="https://example.com">https://example.com</a>`},
+		{"email autolink", "<help@example.com>", "help@example.com (mailto:help@example.com)", `<a href="mailto:help@example.com">help@example.com</a>`},
+		{"javascript autolink", "<javascript:alert(1)>", "javascript:alert(1)", ""},
+		{"mixed case javascript autolink", "<JavaScript:alert(1)>", "JavaScript:alert(1)", ""},
+		{"link with formatting", "[**x**](javascript:alert(1))", "**x**", "<strong>x</strong>"},
+		{"image", "![img](https://example.com/a.png)", "img (https://example.com/a.png)", `<a href="https://example.com/a.png">img</a>`},
+		{"javascript image", "![img](javascript:alert(1))", "img", ""},
+		{"image with markup in alt text", "![<b>](https://example.com/a.png)", "https://example.com/a.png", `<a href="https://example.com/a.png">https://example.com/a.png</a>`},
+
+		{"variables", "Hi {{contact.first_name}}, I'm {{ agent.name }}.", "Hi Eve, I'm Bob Smith.", ""},
+		{"unknown variable", "Hi {{contact.nickname}}!", "Hi !", ""},
+		{"variable with link", "Hi {{contact.name}}", "Hi Eve [click](https://evil.example)", ""},
+		{"variable with html", "Your email is {{contact.email}}", "Your email is <img src=x onerror=alert(1)>", ""},
+		{"variable with formatting", "**Hi** {{contact.phone}}", "**Hi** *1* `2`", "<strong>Hi</strong> *1* `2`"},
+		{"mention", "[@Bob Smith](mention://user/1/Bob%20Smith) can you help?", "@Bob Smith can you help?", ""},
+		{"mention with markup", "[@<b>Bob</b>](mention://user/1/x) and [@*Eve*](mention://user/2/Eve)", "@<b>Bob</b> and @*Eve*", ""},
+	}
+
+	sender := chatwootapi.Sender{ID: 1, Name: "Bob Smith"}
+	conversation := chatwootapi.Conversation{ID: 7}
+	conversation.Meta.Sender = chatwootapi.Contact{
+		Name:        "Eve [click](https://evil.example)",
+		Email:       "<img src=x onerror=alert(1)>",
+		PhoneNumber: "*1* `2`",
+	}
+	variables := chatwootTemplateVariables(sender, conversation)
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			content := renderChatwootMarkdown(test.content, messageAttribution{}, variables, testFormatting)
+			if content.Body != test.body {
+				t.Errorf("unexpected body\nexpected: %q\nactual:   %q", test.body, content.Body)
+			}
+			if content.FormattedBody != test.formattedBody {
+				t.Errorf("unexpected formatted body\nexpected: %q\nactual:   %q", test.formattedBody, content.FormattedBody)
+			}
+		})
+	}
+}
+
+func TestRenderChatwootMarkdownDisabled(t *testing.T) {
+	withRenderMarkdown(t, false)
+
+	variables := map[string]string{"contact.name": "[click](https://evil.example)"}
+	content := renderChatwootMarkdown("**Hi** {{contact.name}} <b>", messageAttribution{}, variables, testFormatting)
+	if content.Body != "**Hi** [click](https://evil.example) <b>" || content.FormattedBody != "" {
+		t.Errorf("expected the message to be sent as plain text, got %+v", content)
+	}
+}
+
+func TestRenderChatwootMarkdownAttribution(t *testing.T) {
+	withRenderMarkdown(t, true)
+
+	tests := []struct {
+		name          string
+		content       string
+		attribution   messageAttribution
+		body          string
+		formattedBody string
+	}{
+		{
+			name:        "plain suffix",
+			content:     "hi",
+			attribution: messageAttribution{Suffix: " - <i>Bob</i>"},
+			body:        "hi - <i>Bob</i>",
+		},
+		{
+			name:          "suffix with formatting",
+			content:       "**hi**",
+			attribution:   messageAttribution{Suffix: " - <i>Bob</i>"},
+			body:          "**hi** - <i>Bob</i>",
+			formattedBody: "<strong>hi</strong> - &lt;i&gt;Bob&lt;/i&gt;",
+		},
+		{
+			name:          "prefix with markdown",
+			content:       "**hi**",
+			attribution:   messageAttribution{Prefix: "**Bob**: "},
+			body:          "**Bob**: **hi**",
+			formattedBody: "**Bob**: <strong>hi</strong>",
+		},
+		{
+			name:          "profile fallback",
+			content:       "hi",
+			attribution:   messageAttribution{Suffix: " - <i>Bob</i>", ProfileFallback: true},
+			body:          "hi - <i>Bob</i>",
+			formattedBody: "hi<span data-mx-profile-fallback> - &lt;i&gt;Bob&lt;/i&gt;</span>",
+		},
+		{
+			name:          "profile fallback in paragraphs",
+			content:       "first\n\nsecond",
+			attribution:   messageAttribution{Prefix: "<Bob> ", Suffix: " </p>", ProfileFallback: true},
+			body:          "<Bob> first\n\nsecond </p>",
+			formattedBody: "<p><span data-mx-profile-fallback>&lt;Bob&gt; </span>first</p>\n<p>second<span data-mx-profile-fallback> &lt;/p&gt;</span></p>",
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			content := renderChatwootMarkdown(test.content, test.attribution, nil, testFormatting)
+			if content.Body != test.body {
+				t.Errorf("unexpected body\nexpected: %q\nactual:   %q", test.body, content.Body)
+			}
+			if content.FormattedBody != test.formattedBody {
+				t.Errorf("unexpected formatted body\nexpected: %q\nactual:   %q", test.formattedBody, content.FormattedBody)
+			}
+		})
+	}
+}
+
+func TestRenderAttributionTemplate(t *testing.T) {
+	withRenderMarkdown(t, true)
+	previous := configuration.Attribution
+	configuration.Attribution = map[string]AttributionConfiguration{
+		"user": {Position: AttributionPositionPrefix, Template: "{{ .DisplayName }}: "},
+	}
+	t.Cleanup(func() { configuration.Attribution = previous })
+
+	sender := chatwootapi.Sender{ID: 1, Type: "user", Name: `<img src=x onerror="alert(1)"> [x](javascript:alert(1))`}
+	attribution := renderAttribution(context.Background(), sender)
+	if attribution.Prefix != sender.Name+": " {
+		t.Fatalf("unexpected attribution prefix %q", attribution.Prefix)
+	}
+
+	content := renderChatwootMarkdown("**hi**", attribution, nil, testFormatting)
+	if strings.Contains(content.FormattedBody, "<img") || strings.Contains(content.FormattedBody, "<a ") {
+		t.Errorf("attribution wasn't escaped: %q", content.FormattedBody)
+	}
+	expected := `&lt;img src=x onerror=&#34;alert(1)&#34;&gt; [x](javascript:alert(1)): <strong>hi</strong>`
+	if content.FormattedBody != expected {
+		t.Errorf("unexpected formatted body\nexpected: %q\nactual:   %q", expected, content.FormattedBody)
+	}
+}
@@ -3,31 +3,46 @@ package main
 import (
 	"bytes"
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"image"
 	_ "image/gif"
 	_ "image/jpeg"
 	_ "image/png"
 	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/hlog"
 	"maunium.net/go/mautrix"
 	"maunium.net/go/mautrix/crypto/attachment"
 	"maunium.net/go/mautrix/event"
-	"maunium.net/go/mautrix/format"
 	"maunium.net/go/mautrix/id"
 
 	"github.com/beeper/chatwoot/chatwootapi"
+	"github.com/beeper/chatwoot/media"
 )
 
 func SendMessage(ctx context.Context, roomID id.RoomID, content *event.MessageEventContent, extraContent ...map[string]any) (resp *mautrix.RespSendEvent, err error) {
-	log := zerolog.Ctx(ctx).With().Str("room_id", roomID.String()).Logger()
+	return SendMessageAs(ctx, client, roomID, content, extraContent...)
+}
+
+// SendMessageAs sends the message with the given client, which is either the
+// bot or the ghost user of an agent.
+func SendMessageAs(ctx context.Context, sendAs *mautrix.Client, roomID id.RoomID, content *event.MessageEventContent, extraContent ...map[string]any) (resp *mautrix.RespSendEvent, err error) {
+	log := zerolog.Ctx(ctx).With().
+		Str("room_id", roomID.String()).
+		Str("send_as", sendAs.UserID.String()).
+		Logger()
 	ctx = log.WithContext(ctx)
 
 	wrappedContent := event.Content{Parsed: content}
@@ -36,7 +51,7 @@ func SendMessage(ctx context.Context, roomID id.RoomID, content *event.MessageEv
 	}
 
 	r, err := DoRetry(ctx, "send message to "+roomID.String(), func(ctx context.Context) (*mautrix.RespSendEvent, error) {
-		return client.SendMessageEvent(roomID, event.EventMessage, &wrappedContent)
+		return sendAs.SendMessageEvent(roomID, event.EventMessage, &wrappedContent)
 	})
 	if err != nil {
 		// give up
@@ -46,46 +61,322 @@ func SendMessage(ctx context.Context, roomID id.RoomID, content *event.MessageEv
 	return r, err
 }
 
+// ValidateWebhookRequest rejects requests that can't be webhook deliveries
+// and limits the size of the request body.
+func ValidateWebhookRequest(maxBodySize int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			log := hlog.FromRequest(r)
+			if r.Method != http.MethodPost {
+				log.Warn().Str("method", r.Method).Msg("rejecting webhook request with invalid method")
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if err != nil || mediaType != "application/json" {
+				log.Warn().Str("content_type", r.Header.Get("Content-Type")).Msg("rejecting webhook request with invalid content type")
+				http.Error(w, "content type must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// webhookErrorStatus returns the status code to respond to Chatwoot with when
+// handling the webhook failed. Chatwoot will retry deliveries that fail with
+// a 5xx status code.
+func webhookErrorStatus(err error) int {
+	if errors.Is(err, sql.ErrNoRows) {
+		// There is no room for the conversation, retrying won't help.
+		return http.StatusUnprocessableEntity
+	} else if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusServiceUnavailable
+	} else if !chatwootapi.IsTemporary(err) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
 func HandleWebhook(w http.ResponseWriter, r *http.Request) {
 	log := hlog.FromRequest(r)
-	ctx := log.WithContext(context.Background())
+	ctx := log.WithContext(r.Context())
 
 	webhookBody, err := io.ReadAll(r.Body)
 	if err != nil {
-		log.Err(err).Msg("failed to read webhook body")
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			log.Warn().Int64("limit", maxBytesErr.Limit).Msg("webhook body too large")
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			log.Err(err).Msg("failed to read webhook body")
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+		}
+		return
 	}
 
-	var eventJson map[string]any
-	err = json.Unmarshal(webhookBody, &eventJson)
+	var webhookEvent chatwootapi.WebhookEvent
+	err = json.Unmarshal(webhookBody, &webhookEvent)
 	if err != nil {
 		log.Err(err).Msg("error decoding webhook body")
+		http.Error(w, "malformed JSON body", http.StatusBadRequest)
+		return
+	} else if webhookEvent.Event == "" {
+		log.Warn().Msg("webhook body has no event type")
+		http.Error(w, "missing event type", http.StatusBadRequest)
 		return
 	}
 
-	if eventType, found := eventJson["event"]; found {
-		switch eventType {
-		case "message_created", "message_updated":
-			var mc chatwootapi.MessageCreated
-			err = json.Unmarshal(webhookBody, &mc)
-			if err != nil {
-				log.Err(err).Msg("error decoding message created webhook body")
-				break
-			}
-			conversationID := mc.Conversation.ID
-			err = HandleMessageCreated(ctx, mc)
-			if err != nil {
-				DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
-					return chatwootAPI.SendPrivateMessage(
-						ctx,
-						conversationID,
-						fmt.Sprintf("**Error occurred while handling Chatwoot message. The message may not have been sent to Matrix!**\n\nError: %+v", err))
-				})
-			}
+	eventLog := log.With().Str("webhook_event", webhookEvent.Event).Logger()
+	log = &eventLog
+	ctx = log.WithContext(ctx)
+
+	handler, found := webhookHandlers[webhookEvent.Event]
+	if !found {
+		log.Debug().Msg("ignoring unknown webhook event")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	// The errors can contain internal details, so they are only logged.
+	err = handler(ctx, webhookBody)
+	if errors.Is(err, errMalformedWebhook) {
+		log.Err(err).Msg("error decoding webhook body")
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Err(err).Msg("failed to handle webhook")
+		status := webhookErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+var errMalformedWebhook = errors.New("malformed webhook body")
+
+type webhookHandler func(ctx context.Context, body []byte) error
+
+// handleTypedWebhook decodes the webhook body into T before calling fn.
+func handleTypedWebhook[T any](fn func(context.Context, T) error) webhookHandler {
+	return func(ctx context.Context, body []byte) error {
+		var evt T
+		if err := json.Unmarshal(body, &evt); err != nil {
+			return fmt.Errorf("%w: %v", errMalformedWebhook, err)
 		}
+		return fn(ctx, evt)
+	}
+}
+
+var webhookHandlers = map[string]webhookHandler{
+	"message_created":             handleTypedWebhook(HandleMessageWebhook),
+	"message_updated":             handleTypedWebhook(HandleMessageWebhook),
+	"conversation_created":        handleTypedWebhook(HandleConversationCreated),
+	"conversation_status_changed": handleTypedWebhook(HandleConversationStatusChanged),
+	"conversation_updated":        handleTypedWebhook(HandleConversationUpdated),
+	"conversation_typing_on":      handleTypedWebhook(HandleConversationTyping),
+	"conversation_typing_off":     handleTypedWebhook(HandleConversationTyping),
+	"contact_created":             handleTypedWebhook(HandleContactCreated),
+	"contact_updated":             handleTypedWebhook(HandleContactUpdated),
+	"webwidget_triggered":         handleTypedWebhook(HandleWebwidgetTriggered),
+}
+
+// HandleMessageWebhook bridges the message and returns the error so that
+// Chatwoot redelivers the webhook on temporary failures. Permanent failures
+// won't be redelivered, so they are reported in the conversation instead.
+func HandleMessageWebhook(ctx context.Context, mc chatwootapi.MessageCreated) error {
+	conversationID := mc.Conversation.ID
+	err := HandleMessageCreated(ctx, mc)
+	if err != nil && webhookErrorStatus(err) < http.StatusInternalServerError {
+		if !mc.Private && mc.MessageType == string(chatwootapi.OutgoingMessage) &&
+			(mc.ContentAttributes == nil || !mc.ContentAttributes.Deleted) {
+			setMessageStatus(ctx, conversationID, mc.ID, chatwootapi.MessageStatusFailed, err.Error())
+		}
+		DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(
+				ctx,
+				conversationID,
+				fmt.Sprintf("**Error occurred while handling Chatwoot message. The message may not have been sent to Matrix!**\n\nError: %+v", err))
+		})
+	}
+	return err
+}
+
+func HandleConversationCreated(ctx context.Context, cc chatwootapi.ConversationCreated) error {
+	zerolog.Ctx(ctx).Info().
+		Int("conversation_id", cc.ID).
+		Str("status", string(cc.Status)).
+		Msg("conversation created")
+	return nil
+}
+
+// statusNoticeKey is added to the conversation status notices sent to Matrix
+// so that they are not bridged back to Chatwoot.
+const statusNoticeKey = "com.beeper.chatwoot.status_notice"
+
+type statusNoticeData struct {
+	Status       chatwootapi.ConversationStatus
+	SnoozedUntil string
+}
+
+func HandleConversationStatusChanged(ctx context.Context, csc chatwootapi.ConversationStatusChanged) error {
+	log := zerolog.Ctx(ctx).With().Int("conversation_id", csc.ID).Logger()
+	ctx = log.WithContext(ctx)
+	log.Info().Str("status", string(csc.Status)).Msg("conversation status changed")
+
+	err := stateStore.UpdateConversationStatus(ctx, csc.ID, string(csc.Status))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to store conversation status")
+	}
+
+	if csc.Status == chatwootapi.ConversationStatusResolved {
+		MarkConversationRead(ctx, csc.ID)
 	}
+
+	noticeTemplate, found := configuration.ConversationStatusNotices[string(csc.Status)]
+	if !found || noticeTemplate == "" {
+		return nil
+	}
+	roomID, _, err := stateStore.GetMatrixRoomFromChatwootConversation(ctx, csc.ID)
+	if err != nil {
+		log.Debug().Err(err).Msg("no room found for conversation, not sending status notice")
+		return nil
+	}
+
+	tmpl, err := template.New("status_notice").Parse(noticeTemplate)
+	if err != nil {
+		log.Err(err).Msg("invalid conversation status notice template")
+		return nil
+	}
+	data := statusNoticeData{Status: csc.Status}
+	if csc.SnoozedUntil != nil && !csc.SnoozedUntil.IsZero() {
+		data.SnoozedUntil = csc.SnoozedUntil.UTC().Format("2006-01-02 15:04 MST")
+	}
+	var notice strings.Builder
+	if err = tmpl.Execute(&notice, data); err != nil {
+		log.Err(err).Msg("failed to render conversation status notice")
+		return nil
+	}
+
+	_, err = SendMessage(ctx, roomID, &event.MessageEventContent{
+		MsgType: event.MsgNotice,
+		Body:    notice.String(),
+	}, map[string]any{
+		statusNoticeKey: string(csc.Status),
+	})
+	return err
+}
+
+func HandleConversationUpdated(ctx context.Context, cu chatwootapi.ConversationUpdated) error {
+	log := zerolog.Ctx(ctx).With().Int("conversation_id", cu.ID).Logger()
+	if _, changed := cu.ChangedAttributes.Get("assignee_id"); changed {
+		if cu.Meta.Assignee != nil {
+			log.Info().Int("assignee_id", cu.Meta.Assignee.ID).Msg("conversation assigned")
+		} else {
+			log.Info().Msg("conversation unassigned")
+		}
+	}
+	if _, changed := cu.ChangedAttributes.Get("agent_last_seen_at"); changed {
+		log.Debug().Msg("agent has seen the conversation")
+		MarkConversationRead(log.WithContext(ctx), cu.ID)
+	} else if _, changed := cu.ChangedAttributes.Get("assignee_last_seen_at"); changed {
+		log.Debug().Msg("assignee has seen the conversation")
+		MarkConversationRead(log.WithContext(ctx), cu.ID)
+	}
+	log.Debug().Interface("changed_attributes", cu.ChangedAttributes).Msg("conversation updated")
+	return nil
+}
+
+// MarkConversationRead sends a read receipt for the most recent event in the
+// room associated with the Chatwoot conversation.
+func MarkConversationRead(ctx context.Context, conversationID int) {
+	log := zerolog.Ctx(ctx)
+	roomID, mostRecentEventID, err := stateStore.GetMatrixRoomFromChatwootConversation(ctx, conversationID)
+	if err != nil {
+		log.Debug().Err(err).Msg("no room found for conversation, not sending read receipt")
+		return
+	}
+	markRead(ctx, roomID, mostRecentEventID)
+}
+
+func markRead(ctx context.Context, roomID id.RoomID, eventID id.EventID) {
+	log := zerolog.Ctx(ctx).With().
+		Str("room_id", roomID.String()).
+		Str("event_id", eventID.String()).
+		Logger()
+	if eventID == "" {
+		log.Debug().Msg("no most recent event in room, not sending read receipt")
+		return
+	}
+	log.Debug().Msg("sending read receipt")
+	if err := client.MarkRead(roomID, eventID); err != nil {
+		log.Warn().Err(err).Msg("failed to send read receipt")
+	}
+}
+
+func HandleConversationTyping(ctx context.Context, ct chatwootapi.ConversationTyping) error {
+	log := zerolog.Ctx(ctx).With().
+		Int("conversation_id", ct.Conversation.ID).
+		Int("user_id", ct.User.ID).
+		Str("user_type", ct.User.Type).
+		Bool("is_private", ct.IsPrivate).
+		Logger()
+
+	// Don't show typing for private notes, for the contact typing in
+	// Chatwoot (including typing that was mirrored from Matrix), or for the
+	// bot's own agent.
+	if ct.IsPrivate || ct.User.Type == "contact" || (chatwootUserID != 0 && ct.User.ID == chatwootUserID) {
+		log.Debug().Msg("not mirroring typing status")
+		return nil
+	}
+
+	roomID, _, err := stateStore.GetMatrixRoomFromChatwootConversation(ctx, ct.Conversation.ID)
+	if err != nil {
+		log.Debug().Err(err).Msg("no room found for conversation")
+		return nil
+	}
+
+	typing := ct.Event == "conversation_typing_on"
+	log.Debug().Bool("typing", typing).Str("room_id", roomID.String()).Msg("setting typing status in room")
+
+	// In appservice mode, the agent types as the same ghost user that sends
+	// their messages. The timeout makes sure that the typing indicator
+	// disappears even if Chatwoot never sends conversation_typing_off.
+	sendAs := senderClient(log.WithContext(ctx), roomID, ct.User.AsSender())
+	timeout := time.Duration(configuration.TypingTimeoutSeconds) * time.Second
+	_, err = sendAs.UserTyping(roomID, typing, timeout)
+	return err
+}
+
+func HandleContactCreated(ctx context.Context, cc chatwootapi.ContactCreated) error {
+	zerolog.Ctx(ctx).Info().
+		Int("contact_id", cc.ID).
+		Str("identifier", cc.Identifier).
+		Msg("contact created")
+	return nil
+}
+
+func HandleContactUpdated(ctx context.Context, cu chatwootapi.ContactUpdated) error {
+	zerolog.Ctx(ctx).Info().
+		Int("contact_id", cu.ID).
+		Str("identifier", cu.Identifier).
+		Interface("changed_attributes", cu.ChangedAttributes).
+		Msg("contact updated")
+	return nil
+}
+
+func HandleWebwidgetTriggered(ctx context.Context, wt chatwootapi.WebwidgetTriggered) error {
+	zerolog.Ctx(ctx).Debug().
+		Int("contact_id", wt.Contact.ID).
+		Str("source_id", wt.SourceID).
+		Msg("web widget triggered")
+	return nil
 }
 
-func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID int, chatwootAttachment chatwootapi.Attachment) (*mautrix.RespSendEvent, error) {
+func handleAttachment(ctx context.Context, sendAs *mautrix.Client, roomID id.RoomID, extraContent map[string]any, chatwootAttachment chatwootapi.Attachment, replyTo id.EventID) (*mautrix.RespSendEvent, error) {
 	log := zerolog.Ctx(ctx).With().
 		Str("func", "handleAttachment").
 		Int("attachment_id", chatwootAttachment.ID).
@@ -114,62 +405,68 @@ func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID i
 	}
 
 	// Calculate the width and height of the image
+	var decodedImage image.Image
+	var imageFormat string
 	if strings.HasPrefix(mimeType, "image/") {
-		image, _, err := image.Decode(bytes.NewReader(attachmentData))
+		decodedImage, imageFormat, err = image.Decode(bytes.NewReader(attachmentData))
 		if err != nil {
 			log.Warn().Err(err).Msg("failed to decode image")
 		} else {
-			bounds := image.Bounds()
+			bounds := decodedImage.Bounds()
 			info.Width = bounds.Dx()
 			info.Height = bounds.Dy()
 		}
 	}
 
-	// Handle the thumbnail if it exists.
+	// Read the duration of audio and video files and the dimensions of
+	// videos. Ogg/Opus audio is what voice recorders produce, so it is sent
+	// as a voice message.
+	var mediaInfo *media.Info
+	if chatwootAttachment.FileType == "audio" || chatwootAttachment.FileType == "video" ||
+		strings.HasPrefix(mimeType, "audio/") || strings.HasPrefix(mimeType, "video/") || mimeType == "application/ogg" {
+		mediaInfo, err = media.Parse(attachmentData)
+		if err != nil {
+			log.Debug().Err(err).Msg("failed to read media metadata")
+		} else {
+			info.MimeType = mediaInfo.MimeType
+			info.Duration = int(mediaInfo.Duration.Milliseconds())
+			info.Width = mediaInfo.Width
+			info.Height = mediaInfo.Height
+		}
+	}
+
+	// Use the thumbnail from Chatwoot if it exists. Otherwise, large images
+	// get a downscaled thumbnail and videos get the embedded cover art or the
+	// placeholder thumbnail, so that clients have something to show before
+	// the full file is loaded.
+	var thumbnailData []byte
 	if len(chatwootAttachment.ThumbURL) > 0 {
-		// Download the thumbnail
-		thumbnailData, err := DoRetryArr(ctx, fmt.Sprintf("Download attachment thumbnail: %s", chatwootAttachment.ThumbURL), func(ctx context.Context) ([]byte, error) {
+		thumbnailData, err = DoRetryArr(ctx, fmt.Sprintf("Download attachment thumbnail: %s", chatwootAttachment.ThumbURL), func(ctx context.Context) ([]byte, error) {
 			return chatwootAPI.DownloadAttachment(ctx, chatwootAttachment.ThumbURL)
 		})
 		if err != nil {
 			return nil, err
 		}
-
-		// Calculate the info for the thumbnail
-		thumbnailMimeType := http.DetectContentType(thumbnailData)
-		info.ThumbnailInfo = &event.FileInfo{
-			MimeType: thumbnailMimeType,
-			Size:     len(thumbnailData),
-		}
-
-		thumbnailImage, _, err := image.Decode(bytes.NewReader(thumbnailData))
+	} else if decodedImage != nil {
+		thumbnailData, err = generateThumbnail(decodedImage, imageFormat)
 		if err != nil {
-			log.Warn().Err(err).Msg("failed to decode image")
-		} else {
-			bounds := thumbnailImage.Bounds()
-			info.ThumbnailInfo.Width = bounds.Dx()
-			info.ThumbnailInfo.Height = bounds.Dy()
+			log.Warn().Err(err).Msg("failed to generate thumbnail")
 		}
-
-		// Encrypt the thumbnail
-		info.ThumbnailFile = &event.EncryptedFileInfo{
-			EncryptedFile: *attachment.NewEncryptedFile(),
-			URL:           "",
+	} else if mediaInfo != nil && mediaInfo.IsVideo() {
+		// The cover art is part of the attachment data, so it is copied
+		// before it's encrypted.
+		thumbnailData = append([]byte(nil), mediaInfo.Thumbnail...)
+		if thumbnailData == nil && configuration.Thumbnails.VideoPlaceholderFile != "" {
+			thumbnailData, err = os.ReadFile(configuration.Thumbnails.VideoPlaceholderFile)
+			if err != nil {
+				log.Warn().Err(err).Msg("failed to read video placeholder thumbnail")
+			}
 		}
-		info.ThumbnailFile.EncryptInPlace(thumbnailData)
-
-		// Upload the thumbnail
-		uploadedThumbnail, err := DoRetry(ctx, "upload thumbnail to Matrix", func(context.Context) (*mautrix.RespMediaUpload, error) {
-			return client.UploadMedia(mautrix.ReqUploadMedia{
-				ContentBytes:  thumbnailData,
-				ContentLength: int64(len(thumbnailData)),
-				ContentType:   "application/octet-stream",
-			})
-		})
-		if err != nil {
+	}
+	if len(thumbnailData) > 0 {
+		if err = uploadThumbnail(ctx, info, thumbnailData); err != nil {
 			return nil, err
 		}
-		info.ThumbnailFile.URL = uploadedThumbnail.ContentURI.CUString()
 	}
 
 	// Encrypt the file
@@ -218,15 +515,76 @@ func handleAttachment(ctx context.Context, roomID id.RoomID, chatwootMessageID i
 		messageType = event.MsgAudio
 	}
 
-	return SendMessage(ctx, roomID, &event.MessageEventContent{
+	content := &event.MessageEventContent{
 		Body:    filename,
 		MsgType: messageType,
 		Info:    info,
 		File:    file,
-	}, map[string]any{
-		"com.beeper.chatwoot.message_id":    chatwootMessageID,
+	}
+	if replyTo != "" {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(replyTo)
+	}
+	extra := map[string]any{
 		"com.beeper.chatwoot.attachment_id": chatwootAttachment.ID,
+	}
+	if mediaInfo != nil && mediaInfo.IsVideo() {
+		content.MsgType = event.MsgVideo
+	} else if mediaInfo != nil {
+		content.MsgType = event.MsgAudio
+		audio := map[string]any{"duration": info.Duration}
+		if mediaInfo.Codec == "opus" {
+			audio["waveform"] = mediaInfo.Waveform
+			extra[voiceKey] = map[string]any{}
+		}
+		extra[audioKey] = audio
+	}
+	for key, value := range extraContent {
+		extra[key] = value
+	}
+	return SendMessageAs(ctx, sendAs, roomID, content, extra)
+}
+
+// uploadThumbnail encrypts and uploads the thumbnail and adds it to the file
+// info.
+func uploadThumbnail(ctx context.Context, info *event.FileInfo, thumbnailData []byte) error {
+	log := zerolog.Ctx(ctx)
+
+	// Calculate the info for the thumbnail
+	thumbnailMimeType := http.DetectContentType(thumbnailData)
+	info.ThumbnailInfo = &event.FileInfo{
+		MimeType: thumbnailMimeType,
+		Size:     len(thumbnailData),
+	}
+
+	thumbnailImage, _, err := image.Decode(bytes.NewReader(thumbnailData))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to decode image")
+	} else {
+		bounds := thumbnailImage.Bounds()
+		info.ThumbnailInfo.Width = bounds.Dx()
+		info.ThumbnailInfo.Height = bounds.Dy()
+	}
+
+	// Encrypt the thumbnail
+	info.ThumbnailFile = &event.EncryptedFileInfo{
+		EncryptedFile: *attachment.NewEncryptedFile(),
+		URL:           "",
+	}
+	info.ThumbnailFile.EncryptInPlace(thumbnailData)
+
+	// Upload the thumbnail
+	uploadedThumbnail, err := DoRetry(ctx, "upload thumbnail to Matrix", func(context.Context) (*mautrix.RespMediaUpload, error) {
+		return client.UploadMedia(mautrix.ReqUploadMedia{
+			ContentBytes:  thumbnailData,
+			ContentLength: int64(len(thumbnailData)),
+			ContentType:   "application/octet-stream",
+		})
 	})
+	if err != nil {
+		return err
+	}
+	info.ThumbnailFile.URL = uploadedThumbnail.ContentURI.CUString()
+	return nil
 }
 
 func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) error {
@@ -241,7 +599,7 @@ func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) er
 		return nil
 	}
 
-	roomID, _, err := stateStore.GetMatrixRoomFromChatwootConversation(ctx, mc.Conversation.ID)
+	roomID, mostRecentEventID, err := stateStore.GetMatrixRoomFromChatwootConversation(ctx, mc.Conversation.ID)
 	if err != nil {
 		log.Err(err).Int("conversation_id", mc.Conversation.ID).Msg("no room found for conversation")
 		return err
@@ -285,43 +643,225 @@ func HandleMessageCreated(ctx context.Context, mc chatwootapi.MessageCreated) er
 	}
 
 	// If there are already Matrix event IDs for this Chatwoot message,
-	// don't try and actually process the chatwoot message.
+	// the message was updated, so only bridge content changes.
 	if len(eventIDs) > 0 {
-		log.Info().
-			Interface("event_ids", eventIDs).
-			Msg("chatwoot message already has matrix event ID(s)")
-		return nil
+		return handleChatwootMessageEdit(ctx, roomID, mc, eventIDs)
+	}
+
+	// The agent is replying, so they have read the user's messages.
+	if mc.MessageType == string(chatwootapi.OutgoingMessage) {
+		markRead(ctx, roomID, mostRecentEventID)
 	}
 
 	// keep track of the latest Matrix event so we can mark it read
 	var resp *mautrix.RespSendEvent
 
 	message := mc.Conversation.Messages[0]
+	sendAs := senderClient(ctx, roomID, message.Sender)
 
-	if message.Content != nil {
-		var messageEventContent event.MessageEventContent
-		messageText := fmt.Sprintf("%s - %s", *message.Content, strings.Split(message.Sender.AvailableName, " ")[0])
-		if configuration.RenderMarkdown {
-			messageEventContent = format.RenderMarkdown(messageText, true, true)
-		} else {
-			messageEventContent = event.MessageEventContent{MsgType: event.MsgText, Body: messageText}
+	// Only the first event of the message is sent as a reply.
+	replyTo := getReplyTarget(ctx, mc)
+
+	if message.Content != nil && mc.ContentType == chatwootapi.ContentTypeInputSelect && mc.ContentAttributes != nil && len(mc.ContentAttributes.Items) > 0 {
+		question := expandChatwootSyntax(*message.Content, chatwootTemplateVariables(message.Sender, mc.Conversation), false)
+		resp, err = sendChatwootPoll(ctx, sendAs, roomID, question, mc.ContentAttributes.Items, chatwootMessageExtraContent(ctx, mc, message.Sender, nil, sendAs != client))
+		if err != nil {
+			return err
 		}
-		resp, err = SendMessage(ctx, roomID, &messageEventContent, map[string]any{
-			"com.beeper.chatwoot.message_id": mc.ID,
-		})
+		stateStore.SetChatwootMessageIdForMatrixEvent(ctx, resp.EventID, mc.ID)
+	} else if message.Content != nil {
+		messageEventContent := renderChatwootMessageContent(ctx, *message.Content, message.Sender, mc.Conversation, sendAs != client)
+		if replyTo != "" {
+			messageEventContent.RelatesTo = (&event.RelatesTo{}).SetReplyTo(replyTo)
+			replyTo = ""
+		}
+		resp, err = SendMessageAs(ctx, sendAs, roomID, &messageEventContent, chatwootMessageExtraContent(ctx, mc, message.Sender, &messageEventContent, sendAs != client))
 		if err != nil {
 			return err
 		}
 		stateStore.SetChatwootMessageIdForMatrixEvent(ctx, resp.EventID, mc.ID)
+		stateStore.SetChatwootMessageContent(ctx, mc.ID, resp.EventID, *message.Content)
 	}
 
 	for _, a := range message.Attachments {
-		resp, err = handleAttachment(ctx, roomID, mc.ID, a)
+		extraContent := chatwootMessageExtraContent(ctx, mc, message.Sender, nil, sendAs != client)
+		if a.FileType == "location" {
+			resp, err = handleLocationAttachment(ctx, sendAs, roomID, extraContent, a, replyTo)
+		} else {
+			resp, err = handleAttachment(ctx, sendAs, roomID, extraContent, a, replyTo)
+		}
 		if err != nil {
 			return err
 		}
+		replyTo = ""
 		stateStore.SetChatwootMessageIdForMatrixEvent(ctx, resp.EventID, mc.ID)
 	}
 
+	if mc.MessageType == string(chatwootapi.OutgoingMessage) {
+		setMessageStatus(ctx, mc.Conversation.ID, mc.ID, chatwootapi.MessageStatusDelivered, "")
+	}
+
 	return nil
 }
+
+// getReplyTarget returns the Matrix event that the Chatwoot message is a reply
+// to, or an empty string if the message is not a reply or the message it
+// replies to was not bridged.
+func getReplyTarget(ctx context.Context, mc chatwootapi.MessageCreated) id.EventID {
+	if mc.ContentAttributes == nil || mc.ContentAttributes.InReplyTo == nil {
+		return ""
+	}
+	inReplyTo := *mc.ContentAttributes.InReplyTo
+	log := zerolog.Ctx(ctx).With().Int("in_reply_to", inReplyTo).Logger()
+
+	// Prefer the event that the text of the message was bridged to.
+	if eventID, _, err := stateStore.GetChatwootMessageContent(ctx, inReplyTo); err == nil {
+		return eventID
+	}
+	eventIDs := stateStore.GetMatrixEventIdsForChatwootMessage(ctx, inReplyTo)
+	if len(eventIDs) == 0 {
+		log.Debug().Msg("no Matrix event for replied to Chatwoot message")
+		return ""
+	}
+	return eventIDs[0]
+}
+
+type attributionData struct {
+	ID          int
+	Type        chatwootapi.SenderType
+	Name        string
+	DisplayName string
+	FirstName   string
+	Email       string
+}
+
+// renderAttribution renders the configured attribution template for the type
+// of the sender.
+func renderAttribution(ctx context.Context, sender chatwootapi.Sender) (attribution messageAttribution) {
+	log := zerolog.Ctx(ctx).With().Str("sender_type", string(sender.GetType())).Logger()
+
+	config, found := configuration.Attribution[string(sender.GetType())]
+	if !found || config.Position == AttributionPositionNone || config.Template == "" {
+		return
+	}
+	tmpl, err := template.New("attribution").Parse(config.Template)
+	if err != nil {
+		log.Err(err).Msg("invalid attribution template")
+		return
+	}
+	data := attributionData{
+		ID:          sender.ID,
+		Type:        sender.GetType(),
+		Name:        sender.Name,
+		DisplayName: sender.DisplayName(),
+		FirstName:   strings.Split(sender.DisplayName(), " ")[0],
+		Email:       sender.Email,
+	}
+	var rendered strings.Builder
+	if err = tmpl.Execute(&rendered, data); err != nil {
+		log.Err(err).Msg("failed to render attribution")
+		return
+	}
+
+	switch config.Position {
+	case AttributionPositionPrefix:
+		attribution.Prefix = rendered.String()
+	case AttributionPositionSuffix:
+		attribution.Suffix = rendered.String()
+	default:
+		log.Warn().Str("position", string(config.Position)).Msg("unknown attribution position")
+	}
+	return
+}
+
+// renderChatwootMessageContent renders the message from the sender. Messages
+// sent by the ghost user of the sender don't need to be attributed.
+func renderChatwootMessageContent(ctx context.Context, content string, sender chatwootapi.Sender, conversation chatwootapi.Conversation, byGhost bool) event.MessageEventContent {
+	var attribution messageAttribution
+	if !byGhost {
+		attribution = renderAttribution(ctx, sender)
+		// Clients that show the per-message profile can hide the attribution.
+		attribution.ProfileFallback = usePerMessageProfile(sender)
+	}
+	return renderChatwootMarkdown(
+		content,
+		attribution,
+		chatwootTemplateVariables(sender, conversation),
+		configuration.FormattingForInbox(conversation.InboxID),
+	)
+}
+
+// chatwootMessageExtraContent returns the extra content to add to the Matrix
+// events for the given Chatwoot message. The content is used to tell whether
+// the message has a fallback for the per-message profile.
+func chatwootMessageExtraContent(ctx context.Context, mc chatwootapi.MessageCreated, sender chatwootapi.Sender, content *event.MessageEventContent, byGhost bool) map[string]any {
+	extra := map[string]any{
+		"com.beeper.chatwoot.message_id": mc.ID,
+	}
+	if !configuration.FormattingForInbox(mc.Conversation.InboxID).LinkPreviews {
+		// An empty list of link previews tells clients not to generate any.
+		extra["com.beeper.linkpreviews"] = []any{}
+	}
+	if byGhost {
+		return extra
+	}
+	if profile := getPerMessageProfile(ctx, sender); profile != nil {
+		profile.HasFallback = content != nil && strings.Contains(content.FormattedBody, "data-mx-profile-fallback")
+		extra[perMessageProfileKey] = profile
+	}
+	return extra
+}
+
+// handleChatwootMessageEdit sends an edit of the bridged message if the
+// content of the Chatwoot message changed. Updates that only change metadata
+// (such as the message status) are ignored.
+func handleChatwootMessageEdit(ctx context.Context, roomID id.RoomID, mc chatwootapi.MessageCreated, eventIDs []id.EventID) error {
+	log := zerolog.Ctx(ctx).With().Interface("event_ids", eventIDs).Logger()
+
+	originalEventID, previousContent, err := stateStore.GetChatwootMessageContent(ctx, mc.ID)
+	if err != nil {
+		log.Info().Err(err).Msg("chatwoot message already has matrix event ID(s) and no stored content")
+		return nil
+	} else if previousContent == mc.Content {
+		log.Debug().Msg("chatwoot message content unchanged, ignoring update")
+		return nil
+	}
+
+	// The most recent message in the conversation has the full sender
+	// information, so prefer it if it's the same message.
+	sender := mc.Sender
+	if len(mc.Conversation.Messages) > 0 && mc.Conversation.Messages[0].ID == mc.ID {
+		sender = mc.Conversation.Messages[0].Sender
+	}
+
+	log.Info().Str("original_event_id", originalEventID.String()).Msg("bridging chatwoot message edit")
+	// Edits have to be sent by the sender of the original event.
+	sendAs := senderClient(ctx, roomID, sender)
+	content := renderChatwootMessageContent(ctx, mc.Content, sender, mc.Conversation, sendAs != client)
+	content.SetEdit(originalEventID)
+	resp, err := SendMessageAs(ctx, sendAs, roomID, &content, chatwootMessageExtraContent(ctx, mc, sender, &content, sendAs != client))
+	if err != nil {
+		return err
+	}
+	stateStore.SetChatwootMessageIdForMatrixEvent(ctx, resp.EventID, mc.ID)
+	return stateStore.SetChatwootMessageContent(ctx, mc.ID, originalEventID, mc.Content)
+}
+
+// setMessageStatus updates the status of the message in Chatwoot and records
+// it so that the message can be marked as read once the user reads it.
+func setMessageStatus(ctx context.Context, conversationID int, messageID int, status chatwootapi.MessageStatus, externalError string) {
+	log := zerolog.Ctx(ctx).With().
+		Int("conversation_id", conversationID).
+		Int("message_id", messageID).
+		Str("status", string(status)).
+		Logger()
+
+	err := chatwootAPI.UpdateMessageStatus(ctx, conversationID, messageID, status, externalError)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to update Chatwoot message status")
+	}
+	err = stateStore.SetChatwootMessageDeliveryStatus(ctx, conversationID, messageID, string(status))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to store Chatwoot message status")
+	}
+}
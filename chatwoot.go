@@ -5,9 +5,11 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"sync"
 	"syscall"
 	"time"
@@ -18,6 +20,7 @@ import (
 	globallog "github.com/rs/zerolog/log"
 	"gopkg.in/yaml.v2"
 	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/appservice"
 	"maunium.net/go/mautrix/crypto"
 	"maunium.net/go/mautrix/crypto/cryptohelper"
 	"maunium.net/go/mautrix/event"
@@ -33,6 +36,7 @@ var configuration Configuration
 var stateStore *database.Database
 
 var chatwootAPI *chatwootapi.ChatwootAPI
+var chatwootUserID int
 var botHomeserver string
 
 var roomSendlocks map[id.RoomID]*sync.Mutex
@@ -51,6 +55,7 @@ var VERSION = "0.2.1"
 func main() {
 	// Arg parsing
 	configPath := flag.String("config", "./config.yaml", "config file location")
+	registrationPath := flag.String("generate-registration", "", "generate an appservice registration file at the given location and exit")
 	flag.Parse()
 
 	// Load configuration
@@ -67,9 +72,43 @@ func main() {
 		ListenPort:                               8080,
 		BridgeIfMembersLessThan:                  -1,
 		RenderMarkdown:                           false,
+		TypingTimeoutSeconds:                     30,
+		Thumbnails: ThumbnailConfiguration{
+			MaxWidth:  800,
+			MaxHeight: 600,
+		},
+		Attribution: map[string]AttributionConfiguration{
+			"user":       {Position: AttributionPositionSuffix, Template: " - {{ .FirstName }}"},
+			"agent_bot":  {Position: AttributionPositionSuffix, Template: " - {{ .Name }}"},
+			"automation": {Position: AttributionPositionNone},
+			"contact":    {Position: AttributionPositionNone},
+		},
+		Formatting: FormattingConfiguration{
+			LinkPreviews:     true,
+			CodeHighlighting: true,
+		},
+		ConversationStatusNotices: map[string]string{
+			"resolved": "This conversation was marked resolved. Reply to reopen it.",
+			"snoozed":  "This conversation was snoozed{{ if .SnoozedUntil }} until {{ .SnoozedUntil }}{{ end }}. Reply to reopen it.",
+		},
+		ChatwootRateLimit: RateLimitConfiguration{
+			RequestsPerSecond: 10,
+			Burst:             20,
+			MaxRetries:        3,
+		},
+		Webhook: WebhookConfiguration{
+			MaxTimestampSkewSeconds: 300,
+			MaxBodySize:             10 * 1024 * 1024,
+		},
 		Backfill: BackfillConfiguration{
 			ChatwootConversations: true,
 		},
+		Appservice: AppserviceConfiguration{
+			ID:                   "chatwoot",
+			Hostname:             "0.0.0.0",
+			Port:                 29320,
+			GhostLocalpartPrefix: "support_agent_",
+		},
 	}
 
 	err = yaml.Unmarshal(configYaml, &configuration)
@@ -86,6 +125,14 @@ func main() {
 	log.Info().Interface("configuration", configuration).Msg("Config loaded")
 	botHomeserver = configuration.Username.Homeserver()
 
+	if *registrationPath != "" {
+		if err = generateRegistration(*registrationPath); err != nil {
+			log.Fatal().Err(err).Msg("Failed to generate appservice registration")
+		}
+		log.Info().Str("registration_path", *registrationPath).Msg("Generated appservice registration, add it to the homeserver configuration")
+		return
+	}
+
 	log.Info().Msg("Chatwoot service starting...")
 
 	// Open the chatwoot database
@@ -118,6 +165,24 @@ func main() {
 		configuration.ChatwootInboxID,
 		accessToken,
 	)
+	chatwootAPI.RateLimiter = chatwootapi.NewRateLimiter(
+		configuration.ChatwootRateLimit.RequestsPerSecond,
+		configuration.ChatwootRateLimit.Burst,
+	)
+	chatwootAPI.MaxRateLimitRetries = configuration.ChatwootRateLimit.MaxRetries
+	chatwootAPI.InboxIdentifier = configuration.ChatwootInboxIdentifier
+
+	// This context is cancelled when the bot is shutting down so that
+	// in-flight requests are cancelled.
+	syncCtx, cancelSync := context.WithCancel(context.Background())
+
+	profile, err := chatwootAPI.GetProfile(log.WithContext(syncCtx))
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to get the Chatwoot profile of the access token")
+	} else {
+		chatwootUserID = profile.ID
+		log.Info().Int("chatwoot_user_id", chatwootUserID).Msg("Got Chatwoot profile")
+	}
 
 	getLogger := func(evt *event.Event) zerolog.Logger {
 		return log.With().
@@ -132,19 +197,33 @@ func main() {
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create crypto helper")
 	}
-	password, err := configuration.GetPassword(log)
-	if err != nil {
-		log.Fatal().Err(err).Str("password_file", configuration.PasswordFile).Msg("Could not read password from ")
-	}
-	cryptoHelper.LoginAs = &mautrix.ReqLogin{
-		Type:       mautrix.AuthTypePassword,
-		Identifier: mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: configuration.Username.String()},
-		Password:   password,
+	if configuration.Appservice.Enabled {
+		appService, err = newAppservice(log)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to create appservice")
+		}
+		// The bot logs in with the appservice token, which gives it a device
+		// that can be used for encryption.
+		client.AccessToken = appService.Registration.AppToken
+		cryptoHelper.LoginAs = &mautrix.ReqLogin{
+			Type:       mautrix.AuthTypeAppservice,
+			Identifier: mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: configuration.Username.String()},
+		}
+	} else {
+		password, err := configuration.GetPassword(log)
+		if err != nil {
+			log.Fatal().Err(err).Str("password_file", configuration.PasswordFile).Msg("Could not read password from ")
+		}
+		cryptoHelper.LoginAs = &mautrix.ReqLogin{
+			Type:       mautrix.AuthTypePassword,
+			Identifier: mautrix.UserIdentifier{Type: mautrix.IdentifierTypeUser, User: configuration.Username.String()},
+			Password:   password,
+		}
 	}
 	cryptoHelper.DBAccountID = configuration.Username.String()
 	cryptoHelper.DecryptErrorCallback = func(evt *event.Event, err error) {
 		log := getLogger(evt)
-		ctx := log.WithContext(context.TODO())
+		ctx := log.WithContext(syncCtx)
 		log.Error().Err(err).Msg("Failed to decrypt message")
 
 		stateStore.UpdateMostRecentEventIdForRoom(ctx, evt.RoomID, evt.ID)
@@ -177,7 +256,7 @@ func main() {
 	syncer := client.Syncer.(*mautrix.DefaultSyncer)
 	syncer.OnEventType(event.EventMessage, func(source mautrix.EventSource, evt *event.Event) {
 		log := getLogger(evt)
-		ctx := log.WithContext(context.TODO())
+		ctx := log.WithContext(syncCtx)
 
 		stateStore.UpdateMostRecentEventIdForRoom(ctx, evt.RoomID, evt.ID)
 		if VerifyFromAuthorizedUser(evt.Sender) {
@@ -185,9 +264,30 @@ func main() {
 			go HandleMessage(ctx, source, evt)
 		}
 	})
+	syncer.OnEventType(event.EventSticker, func(source mautrix.EventSource, evt *event.Event) {
+		log := getLogger(evt)
+		ctx := log.WithContext(syncCtx)
+
+		stateStore.UpdateMostRecentEventIdForRoom(ctx, evt.RoomID, evt.ID)
+		if VerifyFromAuthorizedUser(evt.Sender) {
+			go HandleBeeperClientInfo(ctx, evt)
+			go HandleMessage(ctx, source, evt)
+		}
+	})
+	for _, evtType := range pollEventTypes {
+		syncer.OnEventType(evtType, func(source mautrix.EventSource, evt *event.Event) {
+			log := getLogger(evt)
+			ctx := log.WithContext(syncCtx)
+
+			stateStore.UpdateMostRecentEventIdForRoom(ctx, evt.RoomID, evt.ID)
+			if VerifyFromAuthorizedUser(evt.Sender) {
+				go HandleMessage(ctx, source, evt)
+			}
+		})
+	}
 	syncer.OnEventType(event.EventReaction, func(source mautrix.EventSource, evt *event.Event) {
 		log := getLogger(evt)
-		ctx := log.WithContext(context.TODO())
+		ctx := log.WithContext(syncCtx)
 
 		stateStore.UpdateMostRecentEventIdForRoom(ctx, evt.RoomID, evt.ID)
 		if VerifyFromAuthorizedUser(evt.Sender) {
@@ -197,7 +297,7 @@ func main() {
 	})
 	syncer.OnEventType(event.EventRedaction, func(source mautrix.EventSource, evt *event.Event) {
 		log := getLogger(evt)
-		ctx := log.WithContext(context.TODO())
+		ctx := log.WithContext(syncCtx)
 
 		stateStore.UpdateMostRecentEventIdForRoom(ctx, evt.RoomID, evt.ID)
 		if VerifyFromAuthorizedUser(evt.Sender) {
@@ -205,20 +305,61 @@ func main() {
 			go HandleRedaction(ctx, source, evt)
 		}
 	})
+	syncer.OnEventType(event.EphemeralEventTyping, func(source mautrix.EventSource, evt *event.Event) {
+		log := log.With().
+			Str("event_type", evt.Type.String()).
+			Str("room_id", evt.RoomID.String()).
+			Logger()
+		ctx := log.WithContext(syncCtx)
+
+		go HandleTyping(ctx, source, evt)
+	})
+	syncer.OnEventType(event.EphemeralEventReceipt, func(source mautrix.EventSource, evt *event.Event) {
+		log := log.With().
+			Str("event_type", evt.Type.String()).
+			Str("room_id", evt.RoomID.String()).
+			Logger()
+		ctx := log.WithContext(syncCtx)
+
+		go HandleReceipt(ctx, source, evt)
+	})
 
-	syncCtx, cancelSync := context.WithCancel(context.Background())
 	var syncStopWait sync.WaitGroup
 	syncStopWait.Add(1)
 
-	// Start the sync loop
-	go func() {
-		log.Debug().Msg("starting sync loop")
-		err = client.SyncWithContext(syncCtx)
-		defer syncStopWait.Done()
-		if err != nil && !errors.Is(err, context.Canceled) {
-			log.Fatal().Err(err).Msg("Sync error")
-		}
-	}()
+	if appService != nil {
+		// In appservice mode, the homeserver pushes the events to the
+		// transaction endpoint instead of the bot syncing.
+		eventProcessor := appservice.NewEventProcessor(appService)
+		eventProcessor.ExecMode = appservice.Sync
+		dispatchAppserviceEvents(eventProcessor, syncer)
+		cryptoHelper.Machine().AddAppserviceListener(eventProcessor)
+		eventProcessor.Start()
+
+		go func() {
+			log.Debug().
+				Str("hostname", appService.Host.Hostname).
+				Uint16("port", appService.Host.Port).
+				Msg("starting appservice listener")
+			appService.Start()
+		}()
+		go func() {
+			defer syncStopWait.Done()
+			<-syncCtx.Done()
+			eventProcessor.Stop()
+			appService.Stop()
+		}()
+	} else {
+		// Start the sync loop
+		go func() {
+			log.Debug().Msg("starting sync loop")
+			err = client.SyncWithContext(syncCtx)
+			defer syncStopWait.Done()
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Fatal().Err(err).Msg("Sync error")
+			}
+		}()
+	}
 
 	// Make sure that there are conversations for all of the rooms that the bot
 	// is in.
@@ -230,7 +371,7 @@ func main() {
 
 		for {
 			log := log.With().Str("component", "conversation_creation_backfill").Logger()
-			ctx := log.WithContext(context.Background())
+			ctx := log.WithContext(syncCtx)
 
 			log.Info().Msg("starting to create conversations for rooms that don't have a conversation yet")
 
@@ -288,11 +429,44 @@ func main() {
 	}()
 
 	// Listen to the webhook
-	handler := hlog.NewHandler(*log)(hlog.RequestIDHandler("request_id", "Request-ID")(http.HandlerFunc(HandleWebhook)))
-	http.Handle("/", handler)
-	http.Handle("/webhook", handler)
-	log.Info().Int("listen_port", configuration.ListenPort).Msg("starting webhook listener")
-	err = http.ListenAndServe(fmt.Sprintf(":%d", configuration.ListenPort), nil)
+	signatureSecret, sharedSecret, err := configuration.GetWebhookSecrets(log)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Could not read webhook secrets")
+	}
+	webhookVerifier := NewWebhookVerifier(
+		signatureSecret,
+		sharedSecret,
+		time.Duration(configuration.Webhook.MaxTimestampSkewSeconds)*time.Second,
+	)
+	if !webhookVerifier.Enabled() {
+		log.Warn().Msg("webhook verification is disabled, anyone who can reach the webhook listener can send events")
+	}
+	handler := hlog.NewHandler(*log)(
+		hlog.RequestIDHandler("request_id", "Request-ID")(
+			ValidateWebhookRequest(configuration.Webhook.MaxBodySize)(
+				webhookVerifier.Middleware(http.HandlerFunc(HandleWebhook)),
+			),
+		),
+	)
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	mux.Handle("/webhook", handler)
+	mux.Handle("/webhook/", handler)
+	server := &http.Server{
+		Addr:              net.JoinHostPort(configuration.ListenAddress, strconv.Itoa(configuration.ListenPort)),
+		Handler:           mux,
+		ReadHeaderTimeout: 30 * time.Second,
+	}
+	log.Info().
+		Str("listen_address", configuration.ListenAddress).
+		Int("listen_port", configuration.ListenPort).
+		Bool("tls", configuration.TLSCertFile != "").
+		Msg("starting webhook listener")
+	if configuration.TLSCertFile != "" {
+		err = server.ListenAndServeTLS(configuration.TLSCertFile, configuration.TLSKeyFile)
+	} else {
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("creating the webhook listener failed")
 	}
@@ -355,9 +529,15 @@ func AllowKeyShare(ctx context.Context, device *id.Device, info event.RequestedK
 	}
 	log = log.With().Int("conversation_id", conversationID).Logger()
 
-	conversation, err := chatwootAPI.GetChatwootConversation(conversationID)
-	if err != nil {
-		log.Info().Err(err).Msg("couldn't get Chatwoot conversation")
+	conversation, err := chatwootAPI.GetChatwootConversation(ctx, conversationID)
+	if errors.Is(err, chatwootapi.ErrNotFound) {
+		log.Info().Err(err).Msg("Chatwoot conversation doesn't exist")
+		return &crypto.KeyShareRejectNoResponse
+	} else if errors.Is(err, chatwootapi.ErrUnauthorized) || errors.Is(err, chatwootapi.ErrForbidden) {
+		log.Error().Err(err).Msg("not authorized to get Chatwoot conversation, check the Chatwoot access token")
+		return &crypto.KeyShareRejectNoResponse
+	} else if err != nil {
+		log.Warn().Err(err).Msg("couldn't get Chatwoot conversation")
 		return &crypto.KeyShareRejectNoResponse
 	}
 	log = log.With().Int("sender_identifier", conversation.Meta.Sender.ID).Logger()
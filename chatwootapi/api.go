@@ -13,6 +13,7 @@ import (
 	"net/url"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"maunium.net/go/mautrix/id"
@@ -31,6 +32,16 @@ const (
 	ConversationStatusOpen     ConversationStatus = "open"
 	ConversationStatusResolved ConversationStatus = "resolved"
 	ConversationStatusPending  ConversationStatus = "pending"
+	ConversationStatusSnoozed  ConversationStatus = "snoozed"
+)
+
+type MessageStatus string
+
+const (
+	MessageStatusSent      MessageStatus = "sent"
+	MessageStatusDelivered MessageStatus = "delivered"
+	MessageStatusRead      MessageStatus = "read"
+	MessageStatusFailed    MessageStatus = "failed"
 )
 
 type ChatwootAPI struct {
@@ -38,16 +49,28 @@ type ChatwootAPI struct {
 	AccountID   int
 	InboxID     int
 	AccessToken string
+	// InboxIdentifier is the identifier of the API inbox, which is needed
+	// to act on behalf of contacts through the client API.
+	InboxIdentifier string
 
 	Client *http.Client
+
+	// RateLimiter limits the number of requests made to Chatwoot. It is
+	// paused whenever Chatwoot responds with rate limiting headers.
+	RateLimiter *RateLimiter
+	// MaxRateLimitRetries is the number of times a request that was rejected
+	// with 429 Too Many Requests is retried before the error is returned.
+	MaxRateLimitRetries int
 }
 
 func CreateChatwootAPI(baseURL string, accountID int, inboxID int, accessToken string) *ChatwootAPI {
 	return &ChatwootAPI{
-		BaseURL:     baseURL,
-		AccountID:   accountID,
-		InboxID:     inboxID,
-		AccessToken: accessToken,
+		BaseURL:             baseURL,
+		AccountID:           accountID,
+		InboxID:             inboxID,
+		AccessToken:         accessToken,
+		RateLimiter:         NewRateLimiter(0, 1),
+		MaxRateLimitRetries: 3,
 		Client: &http.Client{
 			CheckRedirect: func(req *http.Request, via []*http.Request) error {
 				if len(via) >= 10 {
@@ -59,10 +82,119 @@ func CreateChatwootAPI(baseURL string, accountID int, inboxID int, accessToken s
 	}
 }
 
+// defaultRateLimitBackoff is how long to pause requests when Chatwoot returns
+// 429 Too Many Requests without saying how long to wait.
+var defaultRateLimitBackoff = 1 * time.Second
+
+// DoRequest performs the request with the access token after waiting for the
+// rate limiter. If Chatwoot responds with 429 Too Many Requests, the request
+// is retried up to MaxRateLimitRetries times.
 func (api *ChatwootAPI) DoRequest(req *http.Request) (*http.Response, error) {
-	req.Header.Add("API_ACCESS_TOKEN", api.AccessToken)
-	req.Header.Set("Content-Type", "application/json")
-	return api.Client.Do(req)
+	req.Header.Set("API_ACCESS_TOKEN", api.AccessToken)
+	return api.doRateLimited(req)
+}
+
+// doRateLimited performs the request without adding the access token, so it
+// is also used for the client API.
+func (api *ChatwootAPI) doRateLimited(req *http.Request) (*http.Response, error) {
+	log := zerolog.Ctx(req.Context()).With().
+		Str("method", req.Method).
+		Str("path", req.URL.Path).
+		Logger()
+
+	if req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	for attempt := 0; ; attempt++ {
+		waited, err := api.RateLimiter.Wait(req.Context())
+		if err != nil {
+			return nil, err
+		} else if waited > 0 {
+			log.Info().Dur("waited", waited).Msg("Throttled Chatwoot request")
+		}
+
+		resp, err := api.Client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		retryAfter := parseRetryAfter(resp.Header, time.Now())
+		if resp.StatusCode == http.StatusTooManyRequests && retryAfter <= 0 {
+			retryAfter = defaultRateLimitBackoff
+		}
+		if retryAfter > 0 {
+			log.Warn().
+				Int("status_code", resp.StatusCode).
+				Dur("retry_after", retryAfter).
+				Msg("Chatwoot rate limit reached, pausing requests")
+			api.RateLimiter.PauseUntil(time.Now().Add(retryAfter))
+		}
+
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= api.MaxRateLimitRetries {
+			return resp, nil
+		} else if req.Body != nil && req.GetBody == nil {
+			// The body can't be replayed, so the request can't be retried.
+			return resp, nil
+		}
+		resp.Body.Close()
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		log.Info().Int("attempt", attempt+1).Msg("Retrying rate limited Chatwoot request")
+	}
+}
+
+// doRequest performs the request and decodes the JSON response into out if
+// out is not nil. If Chatwoot returns a non-2xx status code, an *APIError is
+// returned.
+func (api *ChatwootAPI) doRequest(req *http.Request, endpoint string, out any) error {
+	resp, err := api.DoRequest(req)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, endpoint, out)
+}
+
+// decodeResponse closes the response after decoding the JSON body into out if
+// out is not nil. If the status code isn't 2xx, an *APIError is returned.
+func decodeResponse(resp *http.Response, endpoint string, out any) error {
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return newAPIError(resp, endpoint, body)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// doJSON performs a request to the given endpoint with the payload encoded as
+// JSON (if not nil) and decodes the JSON response into out (if not nil).
+func (api *ChatwootAPI) doJSON(ctx context.Context, method, endpoint string, query url.Values, payload any, out any) error {
+	var body io.Reader
+	if payload != nil {
+		jsonValue, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(jsonValue)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, api.MakeUri(endpoint), body)
+	if err != nil {
+		return err
+	}
+	if query != nil {
+		req.URL.RawQuery = query.Encode()
+	}
+	return api.doRequest(req, endpoint, out)
 }
 
 func (api *ChatwootAPI) MakeUri(endpoint string) string {
@@ -74,6 +206,25 @@ func (api *ChatwootAPI) MakeUri(endpoint string) string {
 	return url.String()
 }
 
+// GetProfile returns the Chatwoot user that the access token belongs to.
+func (api *ChatwootAPI) GetProfile(ctx context.Context) (*User, error) {
+	profileURL, err := url.Parse(api.BaseURL)
+	if err != nil {
+		return nil, err
+	}
+	profileURL.Path = path.Join(profileURL.Path, "api/v1/profile")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, profileURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	var user User
+	err = api.doRequest(req, "profile", &user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
 func (api *ChatwootAPI) CreateContact(ctx context.Context, userID id.UserID) (int, error) {
 	log := zerolog.Ctx(ctx).With().
 		Str("component", "create_contact").
@@ -86,30 +237,10 @@ func (api *ChatwootAPI) CreateContact(ctx context.Context, userID id.UserID) (in
 		Name:       userID.String(),
 		Identifier: userID.String(),
 	}
-	jsonValue, _ := json.Marshal(payload)
-	req, err := http.NewRequest(http.MethodPost, api.MakeUri("contacts"), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		log.Err(err).Msg("Failed to create request")
-		return 0, err
-	}
-
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		log.Err(err).Msg("Failed to make request")
-		return 0, err
-	}
-	if resp.StatusCode != 200 {
-		data, err := io.ReadAll(resp.Body)
-		if err == nil {
-			log.Error().Str("data", string(data)).Msg("got non-200 status code")
-		}
-		return 0, fmt.Errorf("POST contacts returned non-200 status code: %d", resp.StatusCode)
-	}
-
-	decoder := json.NewDecoder(resp.Body)
 	var contactPayload ContactPayload
-	err = decoder.Decode(&contactPayload)
+	err := api.doJSON(ctx, http.MethodPost, "contacts", nil, payload, &contactPayload)
 	if err != nil {
+		log.Err(err).Msg("Failed to create contact")
 		return 0, err
 	}
 
@@ -117,63 +248,34 @@ func (api *ChatwootAPI) CreateContact(ctx context.Context, userID id.UserID) (in
 	return contactPayload.Payload.Contact.ID, nil
 }
 
-func (api *ChatwootAPI) ContactIDForMxid(userID id.UserID) (int, error) {
-	req, err := http.NewRequest(http.MethodGet, api.MakeUri("contacts/search"), nil)
-	if err != nil {
-		return 0, err
-	}
-
-	q := req.URL.Query()
-	q.Add("q", userID.String())
-	req.URL.RawQuery = q.Encode()
-
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return 0, err
-	}
-	if resp.StatusCode != 200 {
-		return 0, fmt.Errorf("GET contacts/search returned non-200 status code: %d", resp.StatusCode)
-	}
-
-	decoder := json.NewDecoder(resp.Body)
-	var contactsPayload ContactsPayload
-	err = decoder.Decode(&contactsPayload)
-	if err != nil {
-		return 0, err
-	}
-	for _, contact := range contactsPayload.Payload {
+func (api *ChatwootAPI) ContactIDForMxid(ctx context.Context, userID id.UserID) (int, error) {
+	contactID := 0
+	err := api.SearchContacts(ctx, userID.String(), func(contact *Contact) error {
 		if contact.Identifier == userID.String() {
-			return contact.ID, nil
+			contactID = contact.ID
+			return ErrStopIteration
 		}
-	}
-
-	return 0, fmt.Errorf("couldn't find user with user ID %s", userID)
-}
-
-func (api *ChatwootAPI) GetChatwootConversation(conversationID int) (*Conversation, error) {
-	req, err := http.NewRequest(http.MethodGet, api.MakeUri(fmt.Sprintf("conversations/%d", conversationID)), nil)
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return 0, err
+	} else if contactID != 0 {
+		return contactID, nil
 	}
 
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("GET conversations/%d returned non-200 status code: %d", conversationID, resp.StatusCode)
-	}
+	return 0, fmt.Errorf("%w: couldn't find user with user ID %s", ErrNotFound, userID)
+}
 
-	decoder := json.NewDecoder(resp.Body)
+func (api *ChatwootAPI) GetChatwootConversation(ctx context.Context, conversationID int) (*Conversation, error) {
 	var conversation Conversation
-	err = decoder.Decode(&conversation)
+	err := api.doJSON(ctx, http.MethodGet, fmt.Sprintf("conversations/%d", conversationID), nil, nil, &conversation)
 	if err != nil {
 		return nil, err
 	}
 	return &conversation, nil
 }
 
-func (api *ChatwootAPI) CreateConversation(sourceID string, contactID int, additionalAttrs map[string]string) (*Conversation, error) {
+func (api *ChatwootAPI) CreateConversation(ctx context.Context, sourceID string, contactID int, additionalAttrs map[string]string) (*Conversation, error) {
 	values := map[string]any{
 		"source_id":             sourceID,
 		"inbox_id":              api.InboxID,
@@ -181,117 +283,39 @@ func (api *ChatwootAPI) CreateConversation(sourceID string, contactID int, addit
 		"status":                "open",
 		"additional_attributes": additionalAttrs,
 	}
-	jsonValue, _ := json.Marshal(values)
-	req, err := http.NewRequest(http.MethodPost, api.MakeUri("conversations"), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("POST conversations returned non-200 status code: %d: %s", resp.StatusCode, string(content))
-	}
-
-	decoder := json.NewDecoder(resp.Body)
 	var conversation Conversation
-	err = decoder.Decode(&conversation)
+	err := api.doJSON(ctx, http.MethodPost, "conversations", nil, values, &conversation)
 	if err != nil {
 		return nil, err
 	}
 	return &conversation, nil
 }
 
-func (api *ChatwootAPI) GetConversationLabels(conversationID int) ([]string, error) {
-	req, err := http.NewRequest(http.MethodGet, api.MakeUri(fmt.Sprintf("conversations/%d/labels", conversationID)), nil)
-	if err != nil {
-		return nil, err
-	}
-
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("POST conversations returned non-200 status code: %d: %s", resp.StatusCode, string(content))
-	}
-
-	decoder := json.NewDecoder(resp.Body)
+func (api *ChatwootAPI) GetConversationLabels(ctx context.Context, conversationID int) ([]string, error) {
 	var labels ConversationLabelsPayload
-	err = decoder.Decode(&labels)
+	err := api.doJSON(ctx, http.MethodGet, fmt.Sprintf("conversations/%d/labels", conversationID), nil, nil, &labels)
 	return labels.Payload, err
 }
 
-func (api *ChatwootAPI) SetConversationLabels(conversationID int, labels []string) error {
-	jsonValue, err := json.Marshal(map[string]any{"labels": labels})
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequest(http.MethodPost, api.MakeUri(fmt.Sprintf("conversations/%d/labels", conversationID)), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		return err
-	}
-
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("POST conversations returned non-200 status code: %d: %s", resp.StatusCode, string(content))
-	}
-	return nil
+func (api *ChatwootAPI) SetConversationLabels(ctx context.Context, conversationID int, labels []string) error {
+	return api.doJSON(ctx, http.MethodPost, fmt.Sprintf("conversations/%d/labels", conversationID), nil, map[string]any{"labels": labels}, nil)
 }
 
-func (api *ChatwootAPI) SetConversationCustomAttributes(conversationID int, customAttrs map[string]string) error {
-	jsonValue, _ := json.Marshal(map[string]any{
+func (api *ChatwootAPI) SetConversationCustomAttributes(ctx context.Context, conversationID int, customAttrs map[string]string) error {
+	return api.doJSON(ctx, http.MethodPost, fmt.Sprintf("conversations/%d/custom_attributes", conversationID), nil, map[string]any{
 		"custom_attributes": customAttrs,
-	})
-	req, err := http.NewRequest(http.MethodPost, api.MakeUri(fmt.Sprintf("conversations/%d/custom_attributes", conversationID)), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		return err
-	}
-
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("POST conversations/%d/custom_attributes returned non-200 status code: %d", conversationID, resp.StatusCode)
-	}
-	return nil
+	}, nil)
 }
 
 func (api *ChatwootAPI) doSendTextMessage(ctx context.Context, conversationID int, jsonValues map[string]any) (*Message, error) {
 	log := zerolog.Ctx(ctx).With().Str("component", "send_text_message").Logger()
-	jsonValue, err := json.Marshal(jsonValues)
-	if err != nil {
-		return nil, err
-	}
-	req, err := http.NewRequest(http.MethodPost, api.MakeUri(fmt.Sprintf("conversations/%d/messages", conversationID)), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		log.Err(err).Msg("Failed to create request")
-		return nil, err
-	}
-
-	resp, err := api.DoRequest(req)
+	var message Message
+	err := api.doJSON(ctx, http.MethodPost, fmt.Sprintf("conversations/%d/messages", conversationID), nil, jsonValues, &message)
 	if err != nil {
-		log.Err(err).Msg("failed to send request")
+		log.Err(err).Msg("failed to send message")
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("POST conversations/%d/messages returned non-200 status code: %d: %s", conversationID, resp.StatusCode, string(content))
-	}
-
-	decoder := json.NewDecoder(resp.Body)
-	var message Message
-	err = decoder.Decode(&message)
-	return &message, err
+	return &message, nil
 }
 
 func (api *ChatwootAPI) SendTextMessage(ctx context.Context, conversationID int, content string, messageType MessageType) (*Message, error) {
@@ -299,34 +323,59 @@ func (api *ChatwootAPI) SendTextMessage(ctx context.Context, conversationID int,
 	return api.doSendTextMessage(ctx, conversationID, values)
 }
 
+// SendReplyMessage sends a message that Chatwoot shows as a reply to the
+// message with the ID inReplyTo.
+func (api *ChatwootAPI) SendReplyMessage(ctx context.Context, conversationID int, content string, messageType MessageType, inReplyTo int) (*Message, error) {
+	values := map[string]any{
+		"content":            content,
+		"message_type":       messageType,
+		"private":            false,
+		"content_attributes": map[string]any{"in_reply_to": inReplyTo},
+	}
+	return api.doSendTextMessage(ctx, conversationID, values)
+}
+
+// UpdateMessageContent changes the content of an existing message. Not all
+// Chatwoot versions support this, so the returned message should be checked
+// to see if the content was actually updated.
+func (api *ChatwootAPI) UpdateMessageContent(ctx context.Context, conversationID int, messageID int, content string) (*Message, error) {
+	var message Message
+	err := api.doJSON(ctx, http.MethodPatch, fmt.Sprintf("conversations/%d/messages/%d", conversationID, messageID), nil, map[string]any{"content": content}, &message)
+	if err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
 func (api *ChatwootAPI) SendPrivateMessage(ctx context.Context, conversationID int, content string) (*Message, error) {
 	values := map[string]any{"content": content, "message_type": OutgoingMessage, "private": true}
 	return api.doSendTextMessage(ctx, conversationID, values)
 }
 
 func (api *ChatwootAPI) ToggleStatus(ctx context.Context, conversationID int, status ConversationStatus) error {
-	jsonValue, err := json.Marshal(map[string]any{"status": status})
-	if err != nil {
-		return err
-	}
-	req, err := http.NewRequest(http.MethodPost, api.MakeUri(fmt.Sprintf("conversations/%d/toggle_status", conversationID)), bytes.NewBuffer(jsonValue))
-	if err != nil {
-		return err
-	}
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("POST conversations/%d/toggle_status returned non-200 status code: %d: %s", conversationID, resp.StatusCode, string(content))
+	return api.doJSON(ctx, http.MethodPost, fmt.Sprintf("conversations/%d/toggle_status", conversationID), nil, map[string]any{"status": status}, nil)
+}
+
+// UpdateMessageStatus sets the status of a message. This is only supported
+// for API inboxes. For the failed status, externalError is shown to the
+// agents as the reason.
+func (api *ChatwootAPI) UpdateMessageStatus(ctx context.Context, conversationID int, messageID int, status MessageStatus, externalError string) error {
+	values := map[string]any{"status": status}
+	if externalError != "" {
+		values["external_error"] = externalError
 	}
-	return nil
+	return api.doJSON(ctx, http.MethodPatch, fmt.Sprintf("conversations/%d/messages/%d", conversationID, messageID), nil, values, nil)
 }
 
 var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
 
-func (api *ChatwootAPI) SendAttachmentMessage(conversationID int, filename string, mimeType string, fileData io.Reader, messageType MessageType) (*Message, error) {
+func (api *ChatwootAPI) SendAttachmentMessage(ctx context.Context, conversationID int, filename string, mimeType string, fileData io.Reader, messageType MessageType) (*Message, error) {
+	return api.SendAttachmentMessageWithContent(ctx, conversationID, "", filename, mimeType, fileData, messageType)
+}
+
+// SendAttachmentMessageWithContent sends an attachment with the given text
+// content in the same message.
+func (api *ChatwootAPI) SendAttachmentMessageWithContent(ctx context.Context, conversationID int, content string, filename string, mimeType string, fileData io.Reader, messageType MessageType) (*Message, error) {
 	bodyBuf := &bytes.Buffer{}
 	bodyWriter := multipart.NewWriter(bodyBuf)
 
@@ -334,7 +383,7 @@ func (api *ChatwootAPI) SendAttachmentMessage(conversationID int, filename strin
 	if err != nil {
 		return nil, err
 	}
-	contentFieldWriter.Write([]byte{})
+	contentFieldWriter.Write([]byte(content))
 
 	privateFieldWriter, err := bodyWriter.CreateFormField("private")
 	if err != nil {
@@ -367,25 +416,15 @@ func (api *ChatwootAPI) SendAttachmentMessage(conversationID int, filename strin
 
 	bodyWriter.Close()
 
-	req, err := http.NewRequest(http.MethodPost, api.MakeUri(fmt.Sprintf("conversations/%d/messages", conversationID)), bodyBuf)
+	endpoint := fmt.Sprintf("conversations/%d/messages", conversationID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, api.MakeUri(endpoint), bodyBuf)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("API_ACCESS_TOKEN", api.AccessToken)
 	req.Header.Set("Content-Type", bodyWriter.FormDataContentType())
 
-	resp, err := api.Client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != 200 {
-		content, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("POST conversations/%d/messages returned non-200 status code: %d: %s", conversationID, resp.StatusCode, string(content))
-	}
-
-	decoder := json.NewDecoder(resp.Body)
 	var message Message
-	err = decoder.Decode(&message)
+	err = api.doRequest(req, endpoint, &message)
 	if err != nil {
 		return nil, err
 	}
@@ -394,7 +433,7 @@ func (api *ChatwootAPI) SendAttachmentMessage(conversationID int, filename strin
 
 func (api *ChatwootAPI) DownloadAttachment(ctx context.Context, url string) ([]byte, error) {
 	log := zerolog.Ctx(ctx)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		log.Err(err).Msg("failed to create request")
 		return nil, err
@@ -404,31 +443,19 @@ func (api *ChatwootAPI) DownloadAttachment(ctx context.Context, url string) ([]b
 		log.Err(err).Msg("failed to do request")
 		return nil, err
 	}
-	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("GET attachment returned non-200 status code: %d", resp.StatusCode)
-	}
+	defer resp.Body.Close()
 
 	data, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Err(err).Msg("failed to read response body")
 		return nil, err
 	}
-	return data, err
-}
-
-func (api *ChatwootAPI) DeleteMessage(conversationID int, messageID int) error {
-	req, err := http.NewRequest(http.MethodDelete, api.MakeUri(fmt.Sprintf("conversations/%d/messages/%d", conversationID, messageID)), nil)
-	if err != nil {
-		return err
-	}
-
-	resp, err := api.DoRequest(req)
-	if err != nil {
-		return err
-	}
-	if resp.StatusCode != 200 {
-		return fmt.Errorf("GET attachment returned non-200 status code: %d", resp.StatusCode)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, newAPIError(resp, req.URL.Path, data)
 	}
+	return data, nil
+}
 
-	return nil
+func (api *ChatwootAPI) DeleteMessage(ctx context.Context, conversationID int, messageID int) error {
+	return api.doJSON(ctx, http.MethodDelete, fmt.Sprintf("conversations/%d/messages/%d", conversationID, messageID), nil, nil, nil)
 }
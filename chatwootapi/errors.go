@@ -0,0 +1,140 @@
+package chatwootapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrRateLimited  = errors.New("rate limited")
+	ErrServerError  = errors.New("server error")
+)
+
+// ErrorResponse is the error body that Chatwoot returns. Depending on the
+// endpoint, Chatwoot uses either the "error" or the "message" and "errors"
+// keys.
+type ErrorResponse struct {
+	Error   string            `json:"error,omitempty"`
+	Message string            `json:"message,omitempty"`
+	Errors  []json.RawMessage `json:"errors,omitempty"`
+}
+
+func (er *ErrorResponse) String() string {
+	var parts []string
+	if er.Error != "" {
+		parts = append(parts, er.Error)
+	}
+	if er.Message != "" {
+		parts = append(parts, er.Message)
+	}
+	for _, e := range er.Errors {
+		var str string
+		if json.Unmarshal(e, &str) == nil {
+			parts = append(parts, str)
+		} else {
+			parts = append(parts, string(e))
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// APIError is returned by all ChatwootAPI methods when Chatwoot responds with
+// a non-2xx status code.
+type APIError struct {
+	Method     string
+	Endpoint   string
+	StatusCode int
+
+	// Response is the decoded Chatwoot error body. It is nil if the body
+	// could not be decoded, in which case RawBody contains the body.
+	Response *ErrorResponse
+	RawBody  string
+
+	// RetryAfter is how long Chatwoot asked us to wait before retrying the
+	// request. It is 0 if Chatwoot didn't send any rate limiting headers.
+	RetryAfter time.Duration
+}
+
+func newAPIError(resp *http.Response, endpoint string, body []byte) *APIError {
+	apiErr := &APIError{
+		Method:     resp.Request.Method,
+		Endpoint:   endpoint,
+		StatusCode: resp.StatusCode,
+		RawBody:    string(body),
+		RetryAfter: parseRetryAfter(resp.Header, time.Now()),
+	}
+	var errResp ErrorResponse
+	if json.Unmarshal(body, &errResp) == nil && errResp.String() != "" {
+		apiErr.Response = &errResp
+	}
+	return apiErr
+}
+
+func (e *APIError) Error() string {
+	msg := e.RawBody
+	if e.Response != nil {
+		msg = e.Response.String()
+	}
+	if msg == "" {
+		return fmt.Sprintf("%s %s returned non-2xx status code %d", e.Method, e.Endpoint, e.StatusCode)
+	}
+	return fmt.Sprintf("%s %s returned non-2xx status code %d: %s", e.Method, e.Endpoint, e.StatusCode, msg)
+}
+
+// Is allows checking the class of the error using errors.Is with one of the
+// Err* sentinel errors.
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrBadRequest:
+		return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrRateLimited:
+		return e.StatusCode == http.StatusTooManyRequests
+	case ErrServerError:
+		return e.StatusCode >= 500
+	}
+	return false
+}
+
+// Temporary returns whether retrying the request may succeed.
+func (e *APIError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// RetryAfter returns how long Chatwoot asked us to wait before retrying. It
+// returns 0 if the error is not an *APIError or Chatwoot didn't say.
+func RetryAfter(err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.RetryAfter
+	}
+	return 0
+}
+
+// IsTemporary returns whether the error is a temporary error. Errors which
+// are not an *APIError (for example, network errors) are considered
+// temporary unless the context was cancelled.
+func IsTemporary(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return true
+}
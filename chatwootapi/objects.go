@@ -1,13 +1,58 @@
 package chatwootapi
 
+import (
+	"encoding/json"
+	"time"
+)
+
+// Timestamp is a time that Chatwoot sends either as a Unix timestamp or as an
+// ISO 8601 string depending on the endpoint.
+type Timestamp struct {
+	time.Time
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+	var unix float64
+	if err := json.Unmarshal(data, &unix); err == nil {
+		t.Time = time.Unix(int64(unix), 0)
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return err
+	} else if str == "" {
+		return nil
+	}
+	parsed, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return err
+	}
+	t.Time = parsed
+	return nil
+}
+
 // Contact
 type Contact struct {
-	ID         int    `json:"id"`
-	Identifier string `json:"identifier"`
+	ID                   int            `json:"id"`
+	Identifier           string         `json:"identifier"`
+	Name                 string         `json:"name,omitempty"`
+	Email                string         `json:"email,omitempty"`
+	PhoneNumber          string         `json:"phone_number,omitempty"`
+	Thumbnail            string         `json:"thumbnail,omitempty"`
+	AdditionalAttributes map[string]any `json:"additional_attributes,omitempty"`
+	CustomAttributes     map[string]any `json:"custom_attributes,omitempty"`
+}
+
+type ContactsMeta struct {
+	Count int `json:"count"`
 }
 
 type ContactsPayload struct {
-	Payload []Contact `json:"payload"`
+	Meta    ContactsMeta `json:"meta"`
+	Payload []Contact    `json:"payload"`
 }
 
 type ContactPayloadInner struct {
@@ -34,15 +79,54 @@ type Attachment struct {
 	AccountID int    `json:"account_id"`
 	DataURL   string `json:"data_url"`
 	ThumbURL  string `json:"thumb_url"`
+
+	// Only set for location attachments
+	CoordinatesLat  float64 `json:"coordinates_lat,omitempty"`
+	CoordinatesLong float64 `json:"coordinates_long,omitempty"`
+	FallbackTitle   string  `json:"fallback_title,omitempty"`
 }
 
 // Message
 
+type SenderType string
+
+const (
+	SenderTypeUser     SenderType = "user"
+	SenderTypeAgentBot SenderType = "agent_bot"
+	SenderTypeContact  SenderType = "contact"
+	// SenderTypeAutomation is used for messages without a sender, such as the
+	// ones sent by automation rules and campaigns.
+	SenderTypeAutomation SenderType = "automation"
+)
+
 type Sender struct {
-	ID            int    `json:"id"`
-	Name          string `json:"name"`
-	Type          string `json:"user"`
-	AvailableName string `json:"available_name"`
+	ID            int        `json:"id"`
+	Name          string     `json:"name"`
+	Type          SenderType `json:"type"`
+	AvailableName string     `json:"available_name,omitempty"`
+	Email         string     `json:"email,omitempty"`
+	PhoneNumber   string     `json:"phone_number,omitempty"`
+	Thumbnail     string     `json:"thumbnail,omitempty"`
+	AvatarURL     string     `json:"avatar_url,omitempty"`
+	Description   string     `json:"description,omitempty"`
+}
+
+// GetType returns the type of the sender. Messages sent by automation rules
+// don't have a sender at all.
+func (s Sender) GetType() SenderType {
+	if s.Type == "" && s.ID == 0 {
+		return SenderTypeAutomation
+	}
+	return s.Type
+}
+
+// DisplayName returns the name that the sender chose to show to contacts,
+// falling back to their full name.
+func (s Sender) DisplayName() string {
+	if s.AvailableName != "" {
+		return s.AvailableName
+	}
+	return s.Name
 }
 
 type Message struct {
@@ -53,25 +137,58 @@ type Message struct {
 	Sender      Sender       `json:"sender"`
 }
 
+type MessagesPayload struct {
+	Payload []Message `json:"payload"`
+}
+
 // Conversation
 
+type User struct {
+	ID            int    `json:"id"`
+	Name          string `json:"name"`
+	AvailableName string `json:"available_name"`
+	Type          string `json:"type"`
+	Email         string `json:"email,omitempty"`
+	Thumbnail     string `json:"thumbnail,omitempty"`
+}
+
+// AsSender returns the user as the sender of a message, such as for the user
+// who is typing in a conversation.
+func (u User) AsSender() Sender {
+	return Sender{
+		ID:            u.ID,
+		Name:          u.Name,
+		Type:          SenderType(u.Type),
+		AvailableName: u.AvailableName,
+		Email:         u.Email,
+		Thumbnail:     u.Thumbnail,
+	}
+}
+
 type ConversationMeta struct {
-	Sender Contact `json:"sender"`
+	Sender   Contact `json:"sender"`
+	Assignee *User   `json:"assignee"`
 }
 
 type Conversation struct {
-	ID               int               `json:"id"`
-	AccountID        int               `json:"account_id"`
-	InboxID          int               `json:"inbox_id"`
-	Messages         []Message         `json:"messages"`
-	Meta             ConversationMeta  `json:"meta"`
-	CustomAttributes map[string]string `json:"custom_attributes"`
+	ID               int                `json:"id"`
+	AccountID        int                `json:"account_id"`
+	InboxID          int                `json:"inbox_id"`
+	Status           ConversationStatus `json:"status"`
+	SnoozedUntil     *Timestamp         `json:"snoozed_until"`
+	Messages         []Message          `json:"messages"`
+	Meta             ConversationMeta   `json:"meta"`
+	CustomAttributes map[string]string  `json:"custom_attributes"`
 }
 
 type ConversationsPayload struct {
 	Payload []Conversation `json:"payload"`
 }
 
+type ConversationListPayload struct {
+	Data ConversationsPayload `json:"data"`
+}
+
 type ConversationLabelsPayload struct {
 	Payload []string `json:"payload"`
 }
@@ -79,9 +196,22 @@ type ConversationLabelsPayload struct {
 // Content Attributes
 
 type ContentAttributes struct {
-	Deleted bool `json:"deleted"`
+	Deleted   bool `json:"deleted"`
+	InReplyTo *int `json:"in_reply_to,omitempty"`
+
+	// The options of input_select messages
+	Items []ContentAttributeItem `json:"items,omitempty"`
+}
+
+type ContentAttributeItem struct {
+	Title string `json:"title"`
+	Value string `json:"value"`
 }
 
+// ContentTypeInputSelect is the content type of messages that ask the contact
+// to choose one of the items.
+const ContentTypeInputSelect = "input_select"
+
 // Webhook
 
 type MessageCreated struct {
@@ -92,5 +222,78 @@ type MessageCreated struct {
 	ContentType       string             `json:"content_type"`
 	ContentAttributes *ContentAttributes `json:"content_attributes"`
 	Private           bool               `json:"private"`
+	Sender            Sender             `json:"sender"`
 	Conversation      Conversation       `json:"conversation"`
 }
+
+// ChangedAttribute is the previous and current value of an attribute that
+// changed in a conversation_updated, conversation_status_changed or
+// contact_updated webhook.
+type ChangedAttribute struct {
+	PreviousValue json.RawMessage `json:"previous_value"`
+	CurrentValue  json.RawMessage `json:"current_value"`
+}
+
+// ChangedAttributes is the list of changes sent by Chatwoot. Each element is
+// a map from the attribute name to the change.
+type ChangedAttributes []map[string]ChangedAttribute
+
+// Get returns the change for the given attribute if it changed.
+func (ca ChangedAttributes) Get(attr string) (ChangedAttribute, bool) {
+	for _, changes := range ca {
+		if change, found := changes[attr]; found {
+			return change, true
+		}
+	}
+	return ChangedAttribute{}, false
+}
+
+type WebhookEvent struct {
+	Event string `json:"event"`
+}
+
+type ConversationCreated struct {
+	Conversation
+	Event string `json:"event"`
+}
+
+type ConversationStatusChanged struct {
+	Conversation
+	Event             string            `json:"event"`
+	ChangedAttributes ChangedAttributes `json:"changed_attributes"`
+}
+
+type ConversationUpdated struct {
+	Conversation
+	Event             string            `json:"event"`
+	ChangedAttributes ChangedAttributes `json:"changed_attributes"`
+}
+
+// ConversationTyping is sent for both conversation_typing_on and
+// conversation_typing_off.
+type ConversationTyping struct {
+	Event        string       `json:"event"`
+	Conversation Conversation `json:"conversation"`
+	User         User         `json:"user"`
+	IsPrivate    bool         `json:"is_private"`
+}
+
+type ContactCreated struct {
+	Contact
+	Event string `json:"event"`
+}
+
+type ContactUpdated struct {
+	Contact
+	Event             string            `json:"event"`
+	ChangedAttributes ChangedAttributes `json:"changed_attributes"`
+}
+
+type WebwidgetTriggered struct {
+	Event               string         `json:"event"`
+	ID                  int            `json:"id"`
+	SourceID            string         `json:"source_id"`
+	Contact             Contact        `json:"contact"`
+	CurrentConversation *Conversation  `json:"current_conversation"`
+	EventInfo           map[string]any `json:"event_info"`
+}
@@ -0,0 +1,45 @@
+package chatwootapi
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestConversationSnoozedUntil(t *testing.T) {
+	snoozedUntil := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		body     string
+		expected time.Time
+	}{
+		{"unix timestamp", `{"id":1,"status":"snoozed","snoozed_until":1709285400}`, snoozedUntil},
+		{"iso 8601 string", `{"id":1,"status":"snoozed","snoozed_until":"2024-03-01T09:30:00.000Z"}`, snoozedUntil},
+		{"null", `{"id":1,"status":"snoozed","snoozed_until":null}`, time.Time{}},
+		{"empty string", `{"id":1,"status":"snoozed","snoozed_until":""}`, time.Time{}},
+		{"missing", `{"id":1,"status":"open"}`, time.Time{}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			var conversation Conversation
+			if err := json.Unmarshal([]byte(test.body), &conversation); err != nil {
+				t.Fatal(err)
+			}
+			var actual time.Time
+			if conversation.SnoozedUntil != nil {
+				actual = conversation.SnoozedUntil.Time
+			}
+			if !actual.Equal(test.expected) {
+				t.Errorf("expected snoozed until %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestConversationSnoozedUntilInvalid(t *testing.T) {
+	var conversation Conversation
+	if err := json.Unmarshal([]byte(`{"id":1,"snoozed_until":"tomorrow"}`), &conversation); err == nil {
+		t.Errorf("expected an error, got %+v", conversation.SnoozedUntil)
+	}
+}
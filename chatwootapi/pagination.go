@@ -0,0 +1,161 @@
+package chatwootapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// ErrStopIteration can be returned from an iteration callback to stop the
+// iteration early without returning an error.
+var ErrStopIteration = errors.New("stop iteration")
+
+func stopIteration(err error) error {
+	if errors.Is(err, ErrStopIteration) {
+		return nil
+	}
+	return err
+}
+
+type ListConversationsOptions struct {
+	// Status filters the conversations by status. If empty, Chatwoot's
+	// default (open) is used. Use "all" to list conversations of any status.
+	Status ConversationStatus
+	// InboxID filters the conversations by inbox. If 0, conversations from
+	// all inboxes are listed.
+	InboxID int
+	// AssigneeType is one of "me", "unassigned", "assigned" or "all".
+	// Defaults to "all".
+	AssigneeType string
+}
+
+// ListConversations calls fn for every conversation matching the options,
+// walking through all of the pages.
+func (api *ChatwootAPI) ListConversations(ctx context.Context, opts ListConversationsOptions, fn func(*Conversation) error) error {
+	query := url.Values{}
+	if opts.Status != "" {
+		query.Set("status", string(opts.Status))
+	}
+	if opts.InboxID != 0 {
+		query.Set("inbox_id", strconv.Itoa(opts.InboxID))
+	}
+	if opts.AssigneeType != "" {
+		query.Set("assignee_type", opts.AssigneeType)
+	} else {
+		query.Set("assignee_type", "all")
+	}
+
+	for page := 1; ; page++ {
+		query.Set("page", strconv.Itoa(page))
+		var resp ConversationListPayload
+		err := api.doJSON(ctx, http.MethodGet, "conversations", query, nil, &resp)
+		if err != nil {
+			return err
+		}
+		if len(resp.Data.Payload) == 0 {
+			return nil
+		}
+		for i := range resp.Data.Payload {
+			if err = fn(&resp.Data.Payload[i]); err != nil {
+				return stopIteration(err)
+			}
+		}
+	}
+}
+
+type ListMessagesOptions struct {
+	// Before only lists messages with an ID less than this message ID. The
+	// messages are walked from newest to oldest.
+	Before int
+	// After only lists messages with an ID greater than this message ID. The
+	// messages are walked from oldest to newest.
+	After int
+}
+
+// ListConversationMessages calls fn for every message in the conversation.
+// If opts.After is set, the messages are walked from oldest to newest
+// starting after that message. Otherwise, the messages are walked from newest
+// to oldest starting before opts.Before (or the newest message if unset).
+func (api *ChatwootAPI) ListConversationMessages(ctx context.Context, conversationID int, opts ListMessagesOptions, fn func(*Message) error) error {
+	if opts.Before != 0 && opts.After != 0 {
+		return fmt.Errorf("only one of before and after can be specified")
+	}
+	forwards := opts.After != 0
+	cursor := opts.Before
+	if forwards {
+		cursor = opts.After
+	}
+
+	endpoint := fmt.Sprintf("conversations/%d/messages", conversationID)
+	for {
+		query := url.Values{}
+		if forwards {
+			query.Set("after", strconv.Itoa(cursor))
+		} else if cursor != 0 {
+			query.Set("before", strconv.Itoa(cursor))
+		}
+
+		var resp MessagesPayload
+		err := api.doJSON(ctx, http.MethodGet, endpoint, query, nil, &resp)
+		if err != nil {
+			return err
+		}
+		if len(resp.Payload) == 0 {
+			return nil
+		}
+
+		// Chatwoot always returns the page sorted from oldest to newest.
+		if forwards {
+			for i := range resp.Payload {
+				if err = fn(&resp.Payload[i]); err != nil {
+					return stopIteration(err)
+				}
+			}
+			next := resp.Payload[len(resp.Payload)-1].ID
+			if next <= cursor {
+				return nil
+			}
+			cursor = next
+		} else {
+			for i := len(resp.Payload) - 1; i >= 0; i-- {
+				if err = fn(&resp.Payload[i]); err != nil {
+					return stopIteration(err)
+				}
+			}
+			next := resp.Payload[0].ID
+			if cursor != 0 && next >= cursor {
+				return nil
+			}
+			cursor = next
+		}
+	}
+}
+
+// SearchContacts calls fn for every contact matching the query, walking
+// through all of the pages.
+func (api *ChatwootAPI) SearchContacts(ctx context.Context, q string, fn func(*Contact) error) error {
+	seen := 0
+	for page := 1; ; page++ {
+		var resp ContactsPayload
+		query := url.Values{"q": {q}, "page": {strconv.Itoa(page)}}
+		err := api.doJSON(ctx, http.MethodGet, "contacts/search", query, nil, &resp)
+		if err != nil {
+			return err
+		}
+		if len(resp.Payload) == 0 {
+			return nil
+		}
+		for i := range resp.Payload {
+			if err = fn(&resp.Payload[i]); err != nil {
+				return stopIteration(err)
+			}
+		}
+		seen += len(resp.Payload)
+		if resp.Meta.Count > 0 && seen >= resp.Meta.Count {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,461 @@
+package chatwootapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+// contactSearchServer serves pages of contacts from contacts/search and
+// records the pages that were requested.
+type contactSearchServer struct {
+	pages [][]Contact
+	count int
+	// failPage makes the server respond with an error for that page.
+	failPage int
+
+	lock      sync.Mutex
+	requested []int
+}
+
+func (s *contactSearchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/accounts/1/contacts/search" {
+		http.NotFound(w, r)
+		return
+	}
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		http.Error(w, `{"error":"invalid page"}`, http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.requested = append(s.requested, page)
+	s.lock.Unlock()
+
+	if page == s.failPage {
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
+	}
+	resp := ContactsPayload{Meta: ContactsMeta{Count: s.count}, Payload: []Contact{}}
+	if page <= len(s.pages) {
+		resp.Payload = s.pages[page-1]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *contactSearchServer) requestedPages() []int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]int(nil), s.requested...)
+}
+
+func newTestAPI(t *testing.T, handler http.Handler) *ChatwootAPI {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	api := CreateChatwootAPI(server.URL, 1, 1, "token")
+	api.Client = server.Client()
+	return api
+}
+
+func contacts(ids ...int) []Contact {
+	result := make([]Contact, 0, len(ids))
+	for _, contactID := range ids {
+		result = append(result, Contact{ID: contactID, Identifier: "@user" + strconv.Itoa(contactID) + ":example.com"})
+	}
+	return result
+}
+
+func TestSearchContacts(t *testing.T) {
+	tests := []struct {
+		name          string
+		pages         [][]Contact
+		count         int
+		expectedIDs   []int
+		expectedPages []int
+	}{
+		{"no results", nil, 0, nil, []int{1}},
+		{"stops at empty page", [][]Contact{contacts(1, 2), contacts(3, 4), contacts(5)}, 0, []int{1, 2, 3, 4, 5}, []int{1, 2, 3, 4}},
+		{"stops at count", [][]Contact{contacts(1, 2), contacts(3, 4), contacts(5)}, 5, []int{1, 2, 3, 4, 5}, []int{1, 2, 3}},
+		{"stops at count on full page", [][]Contact{contacts(1, 2), contacts(3, 4)}, 4, []int{1, 2, 3, 4}, []int{1, 2}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := &contactSearchServer{pages: test.pages, count: test.count}
+			api := newTestAPI(t, server)
+
+			var ids []int
+			err := api.SearchContacts(context.Background(), "query", func(contact *Contact) error {
+				ids = append(ids, contact.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, test.expectedIDs) {
+				t.Errorf("expected contacts %v, got %v", test.expectedIDs, ids)
+			}
+			if !reflect.DeepEqual(server.requestedPages(), test.expectedPages) {
+				t.Errorf("expected pages %v to be requested, got %v", test.expectedPages, server.requestedPages())
+			}
+		})
+	}
+}
+
+func TestSearchContactsStopIteration(t *testing.T) {
+	server := &contactSearchServer{pages: [][]Contact{contacts(1, 2), contacts(3, 4), contacts(5)}}
+	api := newTestAPI(t, server)
+
+	var ids []int
+	err := api.SearchContacts(context.Background(), "query", func(contact *Contact) error {
+		ids = append(ids, contact.ID)
+		if contact.ID == 3 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected stopping the iteration not to be an error, got %v", err)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Errorf("expected the iteration to stop at contact 3, got %v", ids)
+	}
+	if !reflect.DeepEqual(server.requestedPages(), []int{1, 2}) {
+		t.Errorf("expected only pages 1 and 2 to be requested, got %v", server.requestedPages())
+	}
+}
+
+func TestSearchContactsErrors(t *testing.T) {
+	t.Run("callback error", func(t *testing.T) {
+		api := newTestAPI(t, &contactSearchServer{pages: [][]Contact{contacts(1, 2)}})
+		callbackErr := errors.New("callback failed")
+		err := api.SearchContacts(context.Background(), "query", func(contact *Contact) error {
+			return callbackErr
+		})
+		if !errors.Is(err, callbackErr) {
+			t.Errorf("expected the callback error, got %v", err)
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		server := &contactSearchServer{pages: [][]Contact{contacts(1, 2), contacts(3)}, failPage: 2}
+		api := newTestAPI(t, server)
+		var ids []int
+		err := api.SearchContacts(context.Background(), "query", func(contact *Contact) error {
+			ids = append(ids, contact.ID)
+			return nil
+		})
+		var apiErr *APIError
+		if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusInternalServerError {
+			t.Fatalf("expected an API error with status 500, got %v", err)
+		}
+		if !reflect.DeepEqual(ids, []int{1, 2}) {
+			t.Errorf("expected the contacts of the first page, got %v", ids)
+		}
+	})
+}
+
+func TestContactIDForMxid(t *testing.T) {
+	server := &contactSearchServer{pages: [][]Contact{contacts(1, 2), contacts(3, 4)}}
+	api := newTestAPI(t, server)
+
+	contactID, err := api.ContactIDForMxid(context.Background(), id.UserID("@user3:example.com"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contactID != 3 {
+		t.Errorf("expected contact 3 on the second page, got %d", contactID)
+	}
+
+	_, err = api.ContactIDForMxid(context.Background(), id.UserID("@user9:example.com"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound for an unknown user, got %v", err)
+	}
+}
+
+// conversationListServer serves pages of conversations and records the
+// queries of the requests.
+type conversationListServer struct {
+	pages [][]Conversation
+
+	lock    sync.Mutex
+	queries []url.Values
+}
+
+func (s *conversationListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/accounts/1/conversations" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	page, err := strconv.Atoi(query.Get("page"))
+	if err != nil || page < 1 {
+		http.Error(w, `{"error":"invalid page"}`, http.StatusBadRequest)
+		return
+	}
+	s.lock.Lock()
+	s.queries = append(s.queries, query)
+	s.lock.Unlock()
+
+	var resp ConversationListPayload
+	resp.Data.Payload = []Conversation{}
+	if page <= len(s.pages) {
+		resp.Data.Payload = s.pages[page-1]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *conversationListServer) requestedQueries() []url.Values {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]url.Values(nil), s.queries...)
+}
+
+func conversations(ids ...int) []Conversation {
+	result := make([]Conversation, 0, len(ids))
+	for _, conversationID := range ids {
+		result = append(result, Conversation{ID: conversationID})
+	}
+	return result
+}
+
+func TestListConversations(t *testing.T) {
+	tests := []struct {
+		name          string
+		pages         [][]Conversation
+		opts          ListConversationsOptions
+		expectedIDs   []int
+		expectedQuery url.Values
+	}{
+		{
+			name:          "no conversations",
+			expectedQuery: url.Values{"assignee_type": {"all"}},
+		},
+		{
+			name:          "all pages",
+			pages:         [][]Conversation{conversations(1, 2), conversations(3, 4), conversations(5)},
+			expectedIDs:   []int{1, 2, 3, 4, 5},
+			expectedQuery: url.Values{"assignee_type": {"all"}},
+		},
+		{
+			name:          "filters",
+			pages:         [][]Conversation{conversations(1)},
+			opts:          ListConversationsOptions{Status: "all", InboxID: 7, AssigneeType: "unassigned"},
+			expectedIDs:   []int{1},
+			expectedQuery: url.Values{"status": {"all"}, "inbox_id": {"7"}, "assignee_type": {"unassigned"}},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := &conversationListServer{pages: test.pages}
+			api := newTestAPI(t, server)
+
+			var ids []int
+			err := api.ListConversations(context.Background(), test.opts, func(conversation *Conversation) error {
+				ids = append(ids, conversation.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, test.expectedIDs) {
+				t.Errorf("expected conversations %v, got %v", test.expectedIDs, ids)
+			}
+
+			// Every page is requested once, followed by the empty page.
+			queries := server.requestedQueries()
+			if len(queries) != len(test.pages)+1 {
+				t.Fatalf("expected %d requests, got %d", len(test.pages)+1, len(queries))
+			}
+			for i, query := range queries {
+				expected := url.Values{"page": {strconv.Itoa(i + 1)}}
+				for key, values := range test.expectedQuery {
+					expected[key] = values
+				}
+				if !reflect.DeepEqual(query, expected) {
+					t.Errorf("unexpected query for page %d\nexpected: %v\nactual:   %v", i+1, expected, query)
+				}
+			}
+		})
+	}
+}
+
+func TestListConversationsStopIteration(t *testing.T) {
+	server := &conversationListServer{pages: [][]Conversation{conversations(1, 2), conversations(3, 4)}}
+	api := newTestAPI(t, server)
+
+	var ids []int
+	err := api.ListConversations(context.Background(), ListConversationsOptions{}, func(conversation *Conversation) error {
+		ids = append(ids, conversation.ID)
+		if conversation.ID == 2 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected stopping the iteration not to be an error, got %v", err)
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2}) {
+		t.Errorf("expected the iteration to stop at conversation 2, got %v", ids)
+	}
+	if queries := server.requestedQueries(); len(queries) != 1 {
+		t.Errorf("expected only the first page to be requested, got %v", queries)
+	}
+}
+
+// messageListServer serves the messages of a conversation in pages like
+// Chatwoot, sorted from oldest to newest, and records the cursors of the
+// requests.
+type messageListServer struct {
+	messageIDs []int
+	pageSize   int
+
+	lock    sync.Mutex
+	cursors []string
+}
+
+func (s *messageListServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v1/accounts/1/conversations/5/messages" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	before, _ := strconv.Atoi(query.Get("before"))
+	after, _ := strconv.Atoi(query.Get("after"))
+	s.lock.Lock()
+	s.cursors = append(s.cursors, query.Encode())
+	s.lock.Unlock()
+
+	var matching []int
+	for _, messageID := range s.messageIDs {
+		if (before == 0 || messageID < before) && messageID > after {
+			matching = append(matching, messageID)
+		}
+	}
+	// Chatwoot returns the oldest messages after the cursor, or the newest
+	// messages before it.
+	if len(matching) > s.pageSize {
+		if query.Has("after") {
+			matching = matching[:s.pageSize]
+		} else {
+			matching = matching[len(matching)-s.pageSize:]
+		}
+	}
+	resp := MessagesPayload{Payload: []Message{}}
+	for _, messageID := range matching {
+		resp.Payload = append(resp.Payload, Message{ID: messageID})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (s *messageListServer) requestedCursors() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.cursors...)
+}
+
+func TestListConversationMessages(t *testing.T) {
+	messageIDs := []int{1, 2, 3, 4, 5, 6, 7}
+	tests := []struct {
+		name            string
+		opts            ListMessagesOptions
+		expectedIDs     []int
+		expectedCursors []string
+	}{
+		{
+			name:            "newest to oldest",
+			expectedIDs:     []int{7, 6, 5, 4, 3, 2, 1},
+			expectedCursors: []string{"", "before=5", "before=2", "before=1"},
+		},
+		{
+			name:            "before message",
+			opts:            ListMessagesOptions{Before: 6},
+			expectedIDs:     []int{5, 4, 3, 2, 1},
+			expectedCursors: []string{"before=6", "before=3", "before=1"},
+		},
+		{
+			name:            "after message",
+			opts:            ListMessagesOptions{After: 2},
+			expectedIDs:     []int{3, 4, 5, 6, 7},
+			expectedCursors: []string{"after=2", "after=5", "after=7"},
+		},
+		{
+			name:            "after newest message",
+			opts:            ListMessagesOptions{After: 7},
+			expectedCursors: []string{"after=7"},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := &messageListServer{messageIDs: messageIDs, pageSize: 3}
+			api := newTestAPI(t, server)
+
+			var ids []int
+			err := api.ListConversationMessages(context.Background(), 5, test.opts, func(message *Message) error {
+				ids = append(ids, message.ID)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ids, test.expectedIDs) {
+				t.Errorf("expected messages %v, got %v", test.expectedIDs, ids)
+			}
+			if cursors := server.requestedCursors(); !reflect.DeepEqual(cursors, test.expectedCursors) {
+				t.Errorf("expected cursors %q, got %q", test.expectedCursors, cursors)
+			}
+		})
+	}
+}
+
+func TestListConversationMessagesStopIteration(t *testing.T) {
+	server := &messageListServer{messageIDs: []int{1, 2, 3, 4, 5, 6, 7}, pageSize: 3}
+	api := newTestAPI(t, server)
+
+	var ids []int
+	err := api.ListConversationMessages(context.Background(), 5, ListMessagesOptions{}, func(message *Message) error {
+		ids = append(ids, message.ID)
+		if message.ID == 4 {
+			return ErrStopIteration
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected stopping the iteration not to be an error, got %v", err)
+	}
+	if !reflect.DeepEqual(ids, []int{7, 6, 5, 4}) {
+		t.Errorf("expected the iteration to stop at message 4, got %v", ids)
+	}
+	if cursors := server.requestedCursors(); !reflect.DeepEqual(cursors, []string{"", "before=5"}) {
+		t.Errorf("expected two pages to be requested, got %q", cursors)
+	}
+}
+
+func TestListConversationMessagesBothCursors(t *testing.T) {
+	server := &messageListServer{messageIDs: []int{1, 2, 3}, pageSize: 3}
+	api := newTestAPI(t, server)
+
+	err := api.ListConversationMessages(context.Background(), 5, ListMessagesOptions{Before: 3, After: 1}, func(message *Message) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("expected an error when both before and after are set")
+	}
+	if cursors := server.requestedCursors(); len(cursors) != 0 {
+		t.Errorf("expected no requests, got %q", cursors)
+	}
+}
@@ -0,0 +1,75 @@
+package chatwootapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// ErrNoInboxIdentifier is returned by the client API methods if the
+// identifier of the inbox isn't configured.
+var ErrNoInboxIdentifier = errors.New("the inbox identifier is not configured")
+
+// MakePublicUri returns the URL of the endpoint in the client API, which acts
+// on behalf of the contact whose contact inbox has the given source ID
+// instead of an agent.
+func (api *ChatwootAPI) MakePublicUri(sourceID, endpoint string) string {
+	url, err := url.Parse(api.BaseURL)
+	if err != nil {
+		panic(err)
+	}
+	url.Path = path.Join(url.Path, "public/api/v1/inboxes", api.InboxIdentifier, "contacts", sourceID, endpoint)
+	return url.String()
+}
+
+// doPublicJSON performs a request to the client API. The client API is
+// authenticated by the inbox identifier, so the access token isn't sent.
+func (api *ChatwootAPI) doPublicJSON(ctx context.Context, method, sourceID, endpoint string, payload any, out any) error {
+	if api.InboxIdentifier == "" {
+		return ErrNoInboxIdentifier
+	}
+	var body io.Reader
+	if payload != nil {
+		jsonValue, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(jsonValue)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, api.MakePublicUri(sourceID, endpoint), body)
+	if err != nil {
+		return err
+	}
+	resp, err := api.doRateLimited(req)
+	if err != nil {
+		return err
+	}
+	return decodeResponse(resp, endpoint, out)
+}
+
+// SubmitInputSelect records the items that the contact chose as the
+// submitted values of an input_select message.
+func (api *ChatwootAPI) SubmitInputSelect(ctx context.Context, sourceID string, conversationID int, messageID int, items []ContentAttributeItem) error {
+	return api.doPublicJSON(ctx, http.MethodPatch, sourceID, fmt.Sprintf("conversations/%d/messages/%d", conversationID, messageID), map[string]any{
+		"submitted_values": items,
+	}, nil)
+}
+
+// ToggleContactTypingStatus sets whether the contact is typing in the
+// conversation.
+func (api *ChatwootAPI) ToggleContactTypingStatus(ctx context.Context, sourceID string, conversationID int, typing bool) error {
+	typingStatus := "off"
+	if typing {
+		typingStatus = "on"
+	}
+	return api.doPublicJSON(ctx, http.MethodPost, sourceID, fmt.Sprintf("conversations/%d/toggle_typing", conversationID), map[string]any{
+		"typing_status": typingStatus,
+	}, nil)
+}
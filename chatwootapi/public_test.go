@@ -0,0 +1,112 @@
+package chatwootapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+)
+
+// publicRequest is a request that was made to the client API.
+type publicRequest struct {
+	method      string
+	path        string
+	accessToken string
+	body        map[string]any
+}
+
+func newPublicTestAPI(t *testing.T, requests *[]publicRequest) *ChatwootAPI {
+	api := newTestAPI(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("failed to read request body: %v", err)
+		}
+		req := publicRequest{method: r.Method, path: r.URL.Path, accessToken: r.Header.Get("API_ACCESS_TOKEN")}
+		if err = json.Unmarshal(data, &req.body); err != nil {
+			t.Errorf("failed to decode request body: %v", err)
+		}
+		*requests = append(*requests, req)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	api.InboxIdentifier = "inbox-identifier"
+	return api
+}
+
+func TestSubmitInputSelect(t *testing.T) {
+	var requests []publicRequest
+	api := newPublicTestAPI(t, &requests)
+
+	err := api.SubmitInputSelect(context.Background(), "!room:example.com", 5, 42, []ContentAttributeItem{{Title: "Yes", Value: "yes"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 {
+		t.Fatalf("expected one request, got %d", len(requests))
+	}
+	req := requests[0]
+	if req.method != http.MethodPatch || req.path != "/public/api/v1/inboxes/inbox-identifier/contacts/!room:example.com/conversations/5/messages/42" {
+		t.Errorf("unexpected request %s %s", req.method, req.path)
+	}
+	if req.accessToken != "" {
+		t.Errorf("the access token was sent to the client API")
+	}
+	expected := []any{map[string]any{"title": "Yes", "value": "yes"}}
+	if actual, _ := json.Marshal(req.body["submitted_values"]); string(actual) != mustMarshal(t, expected) {
+		t.Errorf("unexpected submitted values %s", actual)
+	}
+}
+
+func TestToggleContactTypingStatus(t *testing.T) {
+	var requests []publicRequest
+	api := newPublicTestAPI(t, &requests)
+
+	for _, typing := range []bool{true, false} {
+		if err := api.ToggleContactTypingStatus(context.Background(), "!room:example.com", 5, typing); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected two requests, got %d", len(requests))
+	}
+	for i, expected := range []string{"on", "off"} {
+		req := requests[i]
+		if req.method != http.MethodPost || req.path != "/public/api/v1/inboxes/inbox-identifier/contacts/!room:example.com/conversations/5/toggle_typing" {
+			t.Errorf("unexpected request %s %s", req.method, req.path)
+		}
+		if req.accessToken != "" {
+			t.Errorf("the access token was sent to the client API")
+		}
+		if req.body["typing_status"] != expected {
+			t.Errorf("expected typing status %q, got %v", expected, req.body["typing_status"])
+		}
+	}
+}
+
+func TestClientAPIWithoutInboxIdentifier(t *testing.T) {
+	var requests []publicRequest
+	api := newPublicTestAPI(t, &requests)
+	api.InboxIdentifier = ""
+
+	err := api.SubmitInputSelect(context.Background(), "!room:example.com", 5, 42, nil)
+	if !errors.Is(err, ErrNoInboxIdentifier) {
+		t.Errorf("expected ErrNoInboxIdentifier when submitting a selection, got %v", err)
+	}
+	err = api.ToggleContactTypingStatus(context.Background(), "!room:example.com", 5, true)
+	if !errors.Is(err, ErrNoInboxIdentifier) {
+		t.Errorf("expected ErrNoInboxIdentifier when setting the typing status, got %v", err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("expected no requests, got %+v", requests)
+	}
+}
+
+func mustMarshal(t *testing.T, value any) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,130 @@
+package chatwootapi
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket rate limiter which can additionally be paused
+// when Chatwoot tells us to back off.
+type RateLimiter struct {
+	lock sync.Mutex
+
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	pausedUntil time.Time
+}
+
+// NewRateLimiter creates a token bucket which allows requestsPerSecond
+// requests per second with bursts of up to burst requests. If
+// requestsPerSecond is not positive, requests are only limited when paused.
+func NewRateLimiter(requestsPerSecond float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   requestsPerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes a token from the bucket and returns how long the caller has
+// to wait before using it.
+func (rl *RateLimiter) reserve() time.Duration {
+	return rl.reserveAt(time.Now())
+}
+
+func (rl *RateLimiter) reserveAt(now time.Time) time.Duration {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+
+	var wait time.Duration
+	if rl.pausedUntil.After(now) {
+		wait = rl.pausedUntil.Sub(now)
+	}
+	if rl.rate <= 0 {
+		return wait
+	}
+
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	rl.tokens--
+	if rl.tokens < 0 {
+		tokenWait := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+		if tokenWait > wait {
+			wait = tokenWait
+		}
+	}
+	return wait
+}
+
+// Wait blocks until a request may be made or the context is cancelled. It
+// returns how long it waited.
+func (rl *RateLimiter) Wait(ctx context.Context) (time.Duration, error) {
+	wait := rl.reserve()
+	if wait <= 0 {
+		return 0, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return wait, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// PauseUntil stops all requests from being made until the given time.
+func (rl *RateLimiter) PauseUntil(until time.Time) {
+	rl.lock.Lock()
+	defer rl.lock.Unlock()
+	if until.After(rl.pausedUntil) {
+		rl.pausedUntil = until
+	}
+}
+
+// parseRetryAfter returns how long Chatwoot wants us to wait before making
+// another request based on the Retry-After and X-RateLimit-* headers. If the
+// headers don't indicate that we should wait, 0 is returned.
+func parseRetryAfter(header http.Header, now time.Time) time.Duration {
+	if retryAfter := header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Duration(seconds) * time.Second
+		} else if date, err := http.ParseTime(retryAfter); err == nil {
+			return date.Sub(now)
+		}
+	}
+
+	remaining := header.Get("X-RateLimit-Remaining")
+	if remaining == "" {
+		remaining = header.Get("RateLimit-Remaining")
+	}
+	if remaining != "0" {
+		return 0
+	}
+	reset := header.Get("X-RateLimit-Reset")
+	if reset == "" {
+		reset = header.Get("RateLimit-Reset")
+	}
+	resetValue, err := strconv.ParseInt(reset, 10, 64)
+	if err != nil {
+		return 0
+	}
+	// The reset header is either a Unix timestamp or a number of seconds.
+	if resetValue > 1_000_000_000 {
+		return time.Unix(resetValue, 0).Sub(now)
+	}
+	return time.Duration(resetValue) * time.Second
+}
@@ -0,0 +1,210 @@
+package chatwootapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{"no headers", http.Header{}, 0},
+		{"retry after seconds", http.Header{"Retry-After": {"30"}}, 30 * time.Second},
+		{"retry after date", http.Header{"Retry-After": {now.Add(90 * time.Second).Format(http.TimeFormat)}}, 90 * time.Second},
+		{"retry after date in the past", http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, -time.Minute},
+		{"garbage retry after", http.Header{"Retry-After": {"soon"}}, 0},
+		{"garbage retry after with rate limit headers", http.Header{
+			"Retry-After":           {"soon"},
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {"5"},
+		}, 5 * time.Second},
+
+		{"reset as delta seconds", http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"12"}}, 12 * time.Second},
+		{"reset as epoch timestamp", http.Header{
+			"X-Ratelimit-Remaining": {"0"},
+			"X-Ratelimit-Reset":     {strconv.FormatInt(now.Add(45*time.Second).Unix(), 10)},
+		}, 45 * time.Second},
+		{"unprefixed rate limit headers", http.Header{"Ratelimit-Remaining": {"0"}, "Ratelimit-Reset": {"3"}}, 3 * time.Second},
+		{"requests remaining", http.Header{"X-Ratelimit-Remaining": {"10"}, "X-Ratelimit-Reset": {"12"}}, 0},
+		{"missing reset", http.Header{"X-Ratelimit-Remaining": {"0"}}, 0},
+		{"garbage reset", http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"later"}}, 0},
+		{"reset without remaining", http.Header{"X-Ratelimit-Reset": {"12"}}, 0},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if actual := parseRetryAfter(test.header, now); actual != test.expected {
+				t.Errorf("expected %v, got %v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRateLimiterReserve(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	type reservation struct {
+		after    time.Duration
+		expected time.Duration
+	}
+	tests := []struct {
+		name         string
+		rate         float64
+		burst        int
+		pause        time.Duration
+		reservations []reservation
+	}{
+		{"burst then wait", 2, 2, 0, []reservation{
+			{0, 0},
+			{0, 0},
+			{0, 500 * time.Millisecond},
+			{0, time.Second},
+		}},
+		{"refill over time", 2, 2, 0, []reservation{
+			{0, 0},
+			{0, 0},
+			{500 * time.Millisecond, 0},
+			{500 * time.Millisecond, 500 * time.Millisecond},
+		}},
+		{"refill is capped at the burst", 1, 2, 0, []reservation{
+			{0, 0},
+			{time.Minute, 0},
+			{time.Minute, 0},
+			{time.Minute, time.Second},
+		}},
+		{"unlimited rate", 0, 1, 0, []reservation{
+			{0, 0},
+			{0, 0},
+			{0, 0},
+		}},
+		{"paused without rate", 0, 1, 3 * time.Second, []reservation{
+			{0, 3 * time.Second},
+			{time.Second, 2 * time.Second},
+			{5 * time.Second, 0},
+		}},
+		{"pause longer than token wait", 1, 1, 3 * time.Second, []reservation{
+			{0, 3 * time.Second},
+			{0, 3 * time.Second},
+		}},
+		{"token wait longer than pause", 1, 1, 500 * time.Millisecond, []reservation{
+			{0, 500 * time.Millisecond},
+			{0, time.Second},
+		}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			rl := NewRateLimiter(test.rate, test.burst)
+			rl.last = start
+			if test.pause > 0 {
+				rl.PauseUntil(start.Add(test.pause))
+			}
+			for i, r := range test.reservations {
+				if actual := rl.reserveAt(start.Add(r.after)); actual != r.expected {
+					t.Errorf("reservation %d: expected to wait %v, got %v", i, r.expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterPauseUntilKeepsLatest(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(0, 1)
+	rl.PauseUntil(start.Add(5 * time.Second))
+	rl.PauseUntil(start.Add(time.Second))
+	if actual := rl.reserveAt(start); actual != 5*time.Second {
+		t.Errorf("expected the later pause to be kept, got %v", actual)
+	}
+}
+
+// rateLimitedServer responds with 429 Too Many Requests until it has been
+// called limitedRequests times.
+type rateLimitedServer struct {
+	limitedRequests int
+
+	lock   sync.Mutex
+	bodies []string
+}
+
+func (s *rateLimitedServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.lock.Lock()
+	s.bodies = append(s.bodies, string(body))
+	count := len(s.bodies)
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if count <= s.limitedRequests {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error":"rate limited"}`))
+		return
+	}
+	w.Write([]byte(`{}`))
+}
+
+func (s *rateLimitedServer) requestBodies() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return append([]string(nil), s.bodies...)
+}
+
+func TestDoRequestRateLimitRetries(t *testing.T) {
+	previous := defaultRateLimitBackoff
+	defaultRateLimitBackoff = time.Millisecond
+	t.Cleanup(func() { defaultRateLimitBackoff = previous })
+
+	tests := []struct {
+		name             string
+		maxRetries       int
+		limitedRequests  int
+		expectedRequests int
+		expectedStatus   int
+	}{
+		{"no rate limiting", 3, 0, 1, http.StatusOK},
+		{"succeeds after retries", 3, 2, 3, http.StatusOK},
+		{"succeeds on the last retry", 3, 3, 4, http.StatusOK},
+		{"gives up after the maximum retries", 3, 10, 4, http.StatusTooManyRequests},
+		{"no retries", 0, 10, 1, http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			server := &rateLimitedServer{limitedRequests: test.limitedRequests}
+			api := newTestAPI(t, server)
+			api.MaxRateLimitRetries = test.maxRetries
+
+			err := api.doJSON(context.Background(), http.MethodPost, "test", nil, map[string]any{"key": "value"}, nil)
+			status := http.StatusOK
+			var apiErr *APIError
+			if errors.As(err, &apiErr) {
+				status = apiErr.StatusCode
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if status != test.expectedStatus {
+				t.Errorf("expected status %d, got %d", test.expectedStatus, status)
+			}
+
+			bodies := server.requestBodies()
+			if len(bodies) != test.expectedRequests {
+				t.Errorf("expected %d requests, got %d", test.expectedRequests, len(bodies))
+			}
+			// Retries have to send the body again.
+			for i, body := range bodies {
+				if body != `{"key":"value"}` {
+					t.Errorf("unexpected body of request %d: %q", i, body)
+				}
+			}
+		})
+	}
+}
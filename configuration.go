@@ -15,17 +15,88 @@ type BackfillConfiguration struct {
 	ConversationIDStateEvents bool `yaml:"conversation_id_state_events"`
 }
 
+type RateLimitConfiguration struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	Burst             int     `yaml:"burst"`
+	MaxRetries        int     `yaml:"max_retries"`
+}
+
+type WebhookConfiguration struct {
+	SignatureSecretFile     string `yaml:"signature_secret_file"`
+	SharedSecretFile        string `yaml:"shared_secret_file"`
+	MaxTimestampSkewSeconds int    `yaml:"max_timestamp_skew_seconds"`
+	MaxBodySize             int64  `yaml:"max_body_size"`
+}
+
+// FormattingConfiguration controls how messages from Chatwoot are rendered
+// in Matrix.
+type FormattingConfiguration struct {
+	LinkPreviews     bool `yaml:"link_previews"`
+	CodeHighlighting bool `yaml:"code_highlighting"`
+}
+
+type AttributionPosition string
+
+const (
+	AttributionPositionPrefix AttributionPosition = "prefix"
+	AttributionPositionSuffix AttributionPosition = "suffix"
+	AttributionPositionNone   AttributionPosition = "none"
+)
+
+// AttributionConfiguration controls how the sender of a Chatwoot message is
+// shown in Matrix.
+type AttributionConfiguration struct {
+	Position AttributionPosition `yaml:"position"`
+	Template string              `yaml:"template"`
+}
+
+// AppserviceConfiguration configures the optional application service mode
+// in which every Chatwoot agent gets their own Matrix ghost user.
+type AppserviceConfiguration struct {
+	Enabled          bool   `yaml:"enabled"`
+	RegistrationFile string `yaml:"registration_file"`
+	ID               string `yaml:"id"`
+	// Address is the URL that the homeserver uses to reach the appservice.
+	Address  string `yaml:"address"`
+	Hostname string `yaml:"hostname"`
+	Port     uint16 `yaml:"port"`
+
+	GhostLocalpartPrefix string `yaml:"ghost_localpart_prefix"`
+}
+
+// ThumbnailConfiguration controls the thumbnails of attachments that Chatwoot
+// doesn't have a thumbnail for.
+type ThumbnailConfiguration struct {
+	// VideoPlaceholderFile is an image that is used as the thumbnail of
+	// videos without embedded cover art.
+	VideoPlaceholderFile string `yaml:"video_placeholder_file"`
+
+	// Images that are larger than the maximum dimensions get a downscaled
+	// thumbnail. Setting either to 0 disables generating thumbnails.
+	MaxWidth  int `yaml:"max_width"`
+	MaxHeight int `yaml:"max_height"`
+}
+
 type Configuration struct {
 	// Authentication settings
 	Homeserver   string    `yaml:"homeserver"`
 	Username     id.UserID `yaml:"username"`
 	PasswordFile string    `yaml:"password_file"`
 
+	// Application service mode
+	Appservice AppserviceConfiguration `yaml:"appservice"`
+
 	// Chatwoot Authentication
 	ChatwootBaseUrl         string `yaml:"chatwoot_base_url"`
 	ChatwootAccessTokenFile string `yaml:"chatwoot_access_token_file"`
 	ChatwootAccountID       int    `yaml:"chatwoot_account_id"`
 	ChatwootInboxID         int    `yaml:"chatwoot_inbox_id"`
+	// The identifier of the API inbox for the client API, which is used to
+	// act on behalf of contacts. Optional.
+	ChatwootInboxIdentifier string `yaml:"chatwoot_inbox_identifier"`
+
+	// Chatwoot rate limiting
+	ChatwootRateLimit RateLimitConfiguration `yaml:"chatwoot_rate_limit"`
 
 	// Database settings
 	Database dbutil.Config `yaml:"database"`
@@ -35,9 +106,28 @@ type Configuration struct {
 	CanonicalDMPrefix                        string `yaml:"canonical_dm_prefix"`
 	BridgeIfMembersLessThan                  int    `yaml:"bridge_if_members_less_than"`
 	RenderMarkdown                           bool   `yaml:"render_markdown"`
+	TypingTimeoutSeconds                     int    `yaml:"typing_timeout_seconds"`
+
+	// Attachment thumbnail settings
+	Thumbnails ThumbnailConfiguration `yaml:"thumbnails"`
+
+	// Sender attribution settings keyed by the Chatwoot sender type
+	Attribution        map[string]AttributionConfiguration `yaml:"attribution"`
+	PerMessageProfiles bool                                `yaml:"per_message_profiles"`
+
+	// Message formatting settings, optionally overridden per inbox
+	Formatting      FormattingConfiguration         `yaml:"formatting"`
+	InboxFormatting map[int]FormattingConfiguration `yaml:"inbox_formatting"`
+
+	// Notices sent to the Matrix room when the conversation status changes
+	ConversationStatusNotices map[string]string `yaml:"conversation_status_notices"`
 
 	// Webhook listener settings
-	ListenPort int `yaml:"listen_port"`
+	ListenAddress string               `yaml:"listen_address"`
+	ListenPort    int                  `yaml:"listen_port"`
+	TLSCertFile   string               `yaml:"tls_cert_file"`
+	TLSKeyFile    string               `yaml:"tls_key_file"`
+	Webhook       WebhookConfiguration `yaml:"webhook"`
 
 	// Logging configuration
 	Logging zeroconfig.Config `yaml:"logging"`
@@ -46,6 +136,15 @@ type Configuration struct {
 	Backfill BackfillConfiguration `yaml:"backfill"`
 }
 
+// FormattingForInbox returns the formatting settings for the given Chatwoot
+// inbox.
+func (c *Configuration) FormattingForInbox(inboxID int) FormattingConfiguration {
+	if formatting, found := c.InboxFormatting[inboxID]; found {
+		return formatting
+	}
+	return c.Formatting
+}
+
 func (c *Configuration) GetPassword(log *zerolog.Logger) (string, error) {
 	log.Debug().Str("password_file", c.PasswordFile).Msg("reading password from file")
 	buf, err := os.ReadFile(c.PasswordFile)
@@ -63,3 +162,23 @@ func (c *Configuration) GetChatwootAccessToken(log *zerolog.Logger) (string, err
 	}
 	return strings.TrimSpace(string(buf)), nil
 }
+
+func (c *Configuration) GetWebhookSecrets(log *zerolog.Logger) (signatureSecret string, sharedSecret string, err error) {
+	if c.Webhook.SignatureSecretFile != "" {
+		log.Debug().Str("signature_secret_file", c.Webhook.SignatureSecretFile).Msg("reading webhook signature secret from file")
+		buf, err := os.ReadFile(c.Webhook.SignatureSecretFile)
+		if err != nil {
+			return "", "", err
+		}
+		signatureSecret = strings.TrimSpace(string(buf))
+	}
+	if c.Webhook.SharedSecretFile != "" {
+		log.Debug().Str("shared_secret_file", c.Webhook.SharedSecretFile).Msg("reading webhook shared secret from file")
+		buf, err := os.ReadFile(c.Webhook.SharedSecretFile)
+		if err != nil {
+			return "", "", err
+		}
+		sharedSecret = strings.TrimSpace(string(buf))
+	}
+	return signatureSecret, sharedSecret, nil
+}
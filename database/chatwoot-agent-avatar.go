@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+// SetAgentAvatar stores the Matrix media that the avatar of the Chatwoot
+// sender was uploaded to.
+func (store *Database) SetAgentAvatar(ctx context.Context, senderType string, senderID int, avatarURL string, mxc id.ContentURIString) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("sender_type", senderType).
+		Int("sender_id", senderID).
+		Str("mxc", string(mxc)).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("setting avatar for chatwoot agent")
+	tx, err := store.DB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	upsert := `
+		INSERT INTO chatwoot_agent_avatar (sender_type, sender_id, avatar_url, mxc)
+			VALUES ($1, $2, $3, $4)
+		ON CONFLICT (sender_type, sender_id) DO UPDATE
+			SET avatar_url = $3, mxc = $4
+	`
+	if _, err := tx.ExecContext(ctx, upsert, senderType, senderID, avatarURL, mxc); err != nil {
+		log.Err(err).Msg("failed to set avatar for chatwoot agent")
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetAgentAvatar returns the avatar URL that was last uploaded for the
+// Chatwoot sender and the Matrix media it was uploaded to.
+func (store *Database) GetAgentAvatar(ctx context.Context, senderType string, senderID int) (string, id.ContentURIString, error) {
+	row := store.DB.QueryRowContext(ctx, `
+		SELECT avatar_url, mxc
+		  FROM chatwoot_agent_avatar
+		 WHERE sender_type = $1 AND sender_id = $2`, senderType, senderID)
+	var avatarURL string
+	var mxc id.ContentURIString
+	if err := row.Scan(&avatarURL, &mxc); err != nil {
+		return "", "", err
+	}
+	return avatarURL, mxc, nil
+}
@@ -92,3 +92,44 @@ func (store *Database) UpdateConversationIdForRoom(ctx context.Context, roomID i
 
 	return tx.Commit()
 }
+
+func (store *Database) UpdateConversationStatus(ctx context.Context, conversationID int, status string) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "update_conversation_status").
+		Int("conversation_id", conversationID).
+		Str("status", status).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("setting conversation status")
+	tx, err := store.DB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	update := `
+		UPDATE chatwoot_conversation_to_matrix_room
+		SET chatwoot_conversation_status = $2
+		WHERE chatwoot_conversation_id = $1
+	`
+	if _, err := tx.ExecContext(ctx, update, conversationID, status); err != nil {
+		tx.Rollback()
+		log.Err(err).Msg("failed to update conversation status")
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *Database) GetConversationStatusForRoom(ctx context.Context, roomID id.RoomID) (string, error) {
+	row := store.DB.QueryRowContext(ctx, `
+		SELECT chatwoot_conversation_status
+		  FROM chatwoot_conversation_to_matrix_room
+		 WHERE matrix_room_id = $1`, roomID)
+	var status sql.NullString
+	if err := row.Scan(&status); err != nil {
+		return "", err
+	}
+	return status.String, nil
+}
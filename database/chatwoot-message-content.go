@@ -0,0 +1,54 @@
+package database
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+// SetChatwootMessageContent stores the content of a Chatwoot message and the
+// Matrix event that the content was bridged to.
+func (store *Database) SetChatwootMessageContent(ctx context.Context, chatwootMessageID int, eventID id.EventID, content string) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("event_id", eventID.String()).
+		Int("chatwoot_message_id", chatwootMessageID).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("setting content for chatwoot message")
+	tx, err := store.DB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	upsert := `
+		INSERT INTO chatwoot_message_content (chatwoot_message_id, matrix_event_id, content)
+			VALUES ($1, $2, $3)
+		ON CONFLICT (chatwoot_message_id) DO UPDATE
+			SET matrix_event_id = $2, content = $3
+	`
+	if _, err := tx.ExecContext(ctx, upsert, chatwootMessageID, eventID, content); err != nil {
+		log.Err(err).Msg("failed to set content for chatwoot message")
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetChatwootMessageContent returns the Matrix event that the Chatwoot
+// message content was bridged to and the content at the time.
+func (store *Database) GetChatwootMessageContent(ctx context.Context, chatwootMessageID int) (id.EventID, string, error) {
+	row := store.DB.QueryRowContext(ctx, `
+		SELECT matrix_event_id, content
+		  FROM chatwoot_message_content
+		 WHERE chatwoot_message_id = $1`, chatwootMessageID)
+	var eventID id.EventID
+	var content string
+	if err := row.Scan(&eventID, &content); err != nil {
+		return "", "", err
+	}
+	return eventID, content, nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+func (store *Database) SetChatwootMessageDeliveryStatus(ctx context.Context, conversationID int, messageID int, status string) error {
+	log := zerolog.Ctx(ctx).With().
+		Int("conversation_id", conversationID).
+		Int("chatwoot_message_id", messageID).
+		Str("status", status).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("setting delivery status for chatwoot message")
+	tx, err := store.DB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	upsert := `
+		INSERT INTO chatwoot_message_delivery_status (chatwoot_message_id, chatwoot_conversation_id, status)
+			VALUES ($1, $2, $3)
+		ON CONFLICT (chatwoot_message_id) DO UPDATE
+			SET status = $3
+	`
+	if _, err := tx.ExecContext(ctx, upsert, messageID, conversationID, status); err != nil {
+		log.Err(err).Msg("failed to set delivery status for chatwoot message")
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetChatwootMessagesWithDeliveryStatus returns the IDs of all of the
+// messages in the conversation with the given status whose ID is at most
+// maxMessageID.
+func (store *Database) GetChatwootMessagesWithDeliveryStatus(ctx context.Context, conversationID int, status string, maxMessageID int) ([]int, error) {
+	log := zerolog.Ctx(ctx).With().
+		Int("conversation_id", conversationID).
+		Str("status", status).
+		Logger()
+
+	rows, err := store.DB.QueryContext(ctx, `
+		SELECT chatwoot_message_id
+		  FROM chatwoot_message_delivery_status
+		 WHERE chatwoot_conversation_id = $1
+		   AND status = $2
+		   AND chatwoot_message_id <= $3`, conversationID, status, maxMessageID)
+	if err != nil {
+		log.Err(err).Msg("failed to get chatwoot messages with delivery status")
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messageIDs []int
+	var messageID int
+	for rows.Next() {
+		if err := rows.Scan(&messageID); err == nil {
+			messageIDs = append(messageIDs, messageID)
+		}
+	}
+	return messageIDs, rows.Err()
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+func (store *Database) AddMatrixEventEdit(ctx context.Context, originalEventID id.EventID, editEventID id.EventID, body string, timestamp int64) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("original_event_id", originalEventID.String()).
+		Str("edit_event_id", editEventID.String()).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	log.Debug().Msg("adding edit of matrix event")
+	tx, err := store.DB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	insert := `
+		INSERT INTO matrix_event_edit (edit_event_id, original_event_id, body, timestamp)
+			VALUES ($1, $2, $3, $4)
+		ON CONFLICT (edit_event_id) DO NOTHING
+	`
+	if _, err := tx.ExecContext(ctx, insert, editEventID, originalEventID, body, timestamp); err != nil {
+		log.Err(err).Msg("failed to add edit of matrix event")
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetLatestMatrixEventEditBody returns the body of the most recent edit of
+// the event. If the event has not been edited, an empty string is returned.
+func (store *Database) GetLatestMatrixEventEditBody(ctx context.Context, originalEventID id.EventID) (string, error) {
+	row := store.DB.QueryRowContext(ctx, `
+		SELECT body
+		  FROM matrix_event_edit
+		 WHERE original_event_id = $1
+		 ORDER BY timestamp DESC
+		 LIMIT 1`, originalEventID)
+	var body string
+	if err := row.Scan(&body); errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return body, nil
+}
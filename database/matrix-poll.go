@@ -0,0 +1,152 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix/id"
+)
+
+type PollAnswer struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+	// Value is the value of the item for polls from Chatwoot.
+	Value string `json:"value,omitempty"`
+}
+
+// MatrixPoll is a poll in a Matrix room. Polls from Chatwoot are the
+// input_select messages sent by agents and bots, in which case votes are sent
+// back to Chatwoot as the selection of the user.
+type MatrixPoll struct {
+	EventID       id.EventID
+	RoomID        id.RoomID
+	Sender        id.UserID
+	Question      string
+	Answers       []PollAnswer
+	MaxSelections int
+	FromChatwoot  bool
+}
+
+// Answer returns the answer with the given ID.
+func (poll *MatrixPoll) Answer(answerID string) (PollAnswer, bool) {
+	for _, answer := range poll.Answers {
+		if answer.ID == answerID {
+			return answer, true
+		}
+	}
+	return PollAnswer{}, false
+}
+
+func (store *Database) AddMatrixPoll(ctx context.Context, poll *MatrixPoll) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("poll_event_id", poll.EventID.String()).
+		Bool("from_chatwoot", poll.FromChatwoot).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	answers, err := json.Marshal(poll.Answers)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msg("adding matrix poll")
+	tx, err := store.DB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	insert := `
+		INSERT INTO matrix_poll (poll_event_id, room_id, sender, question, answers, max_selections, from_chatwoot)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (poll_event_id) DO NOTHING
+	`
+	if _, err := tx.ExecContext(ctx, insert, poll.EventID, poll.RoomID, poll.Sender, poll.Question, string(answers), poll.MaxSelections, poll.FromChatwoot); err != nil {
+		log.Err(err).Msg("failed to add matrix poll")
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (store *Database) GetMatrixPoll(ctx context.Context, pollEventID id.EventID) (*MatrixPoll, error) {
+	row := store.DB.QueryRowContext(ctx, `
+		SELECT poll_event_id, room_id, sender, question, answers, max_selections, from_chatwoot
+		  FROM matrix_poll
+		 WHERE poll_event_id = $1`, pollEventID)
+	var poll MatrixPoll
+	var answers string
+	if err := row.Scan(&poll.EventID, &poll.RoomID, &poll.Sender, &poll.Question, &answers, &poll.MaxSelections, &poll.FromChatwoot); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(answers), &poll.Answers); err != nil {
+		return nil, err
+	}
+	return &poll, nil
+}
+
+// SetMatrixPollVote stores the vote of the user. Only the most recent vote of
+// each user counts, so older votes are ignored.
+func (store *Database) SetMatrixPollVote(ctx context.Context, pollEventID id.EventID, userID id.UserID, answerIDs []string, timestamp int64) error {
+	log := zerolog.Ctx(ctx).With().
+		Str("poll_event_id", pollEventID.String()).
+		Str("user_id", userID.String()).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	answers, err := json.Marshal(answerIDs)
+	if err != nil {
+		return err
+	}
+
+	log.Debug().Msg("setting vote on matrix poll")
+	tx, err := store.DB.Begin()
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	upsert := `
+		INSERT INTO matrix_poll_vote (poll_event_id, user_id, answers, timestamp)
+			VALUES ($1, $2, $3, $4)
+		ON CONFLICT (poll_event_id, user_id) DO UPDATE
+			SET answers = $3, timestamp = $4
+			WHERE matrix_poll_vote.timestamp < $4
+	`
+	if _, err := tx.ExecContext(ctx, upsert, pollEventID, userID, string(answers), timestamp); err != nil {
+		log.Err(err).Msg("failed to set vote on matrix poll")
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// GetMatrixPollVotes returns the answers that each user voted for.
+func (store *Database) GetMatrixPollVotes(ctx context.Context, pollEventID id.EventID) (map[id.UserID][]string, error) {
+	rows, err := store.DB.QueryContext(ctx, `
+		SELECT user_id, answers
+		  FROM matrix_poll_vote
+		 WHERE poll_event_id = $1`, pollEventID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	votes := map[id.UserID][]string{}
+	for rows.Next() {
+		var userID id.UserID
+		var answers string
+		if err := rows.Scan(&userID, &answers); err != nil {
+			return nil, err
+		}
+		var answerIDs []string
+		if err := json.Unmarshal([]byte(answers), &answerIDs); err != nil {
+			return nil, err
+		}
+		votes[userID] = answerIDs
+	}
+	return votes, rows.Err()
+}
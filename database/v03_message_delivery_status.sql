@@ -0,0 +1,10 @@
+-- v3: Track the delivery status of Chatwoot messages in Matrix
+
+CREATE TABLE chatwoot_message_delivery_status (
+	chatwoot_message_id       INTEGER PRIMARY KEY,
+	chatwoot_conversation_id  INTEGER NOT NULL,
+	status                    TEXT    NOT NULL
+);
+
+CREATE INDEX chatwoot_message_delivery_status_conversation_idx
+	ON chatwoot_message_delivery_status (chatwoot_conversation_id, status);
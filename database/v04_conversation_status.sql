@@ -0,0 +1,4 @@
+-- v4: Store the Chatwoot conversation status
+
+ALTER TABLE chatwoot_conversation_to_matrix_room
+ADD COLUMN chatwoot_conversation_status VARCHAR(255);
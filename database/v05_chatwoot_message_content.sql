@@ -0,0 +1,7 @@
+-- v5: Store the content of Chatwoot messages bridged to Matrix
+
+CREATE TABLE chatwoot_message_content (
+	chatwoot_message_id  INTEGER      PRIMARY KEY,
+	matrix_event_id      VARCHAR(255) NOT NULL,
+	content              TEXT         NOT NULL
+);
@@ -0,0 +1,10 @@
+-- v6: Track edits of Matrix events bridged to Chatwoot
+
+CREATE TABLE matrix_event_edit (
+	edit_event_id      VARCHAR(255) PRIMARY KEY,
+	original_event_id  VARCHAR(255) NOT NULL,
+	body               TEXT         NOT NULL,
+	timestamp          BIGINT       NOT NULL
+);
+
+CREATE INDEX matrix_event_edit_original_event_id_idx ON matrix_event_edit (original_event_id);
@@ -0,0 +1,10 @@
+-- v7: Cache the Matrix media of Chatwoot agent avatars
+
+CREATE TABLE chatwoot_agent_avatar (
+	sender_type  VARCHAR(32)  NOT NULL,
+	sender_id    INTEGER      NOT NULL,
+	avatar_url   TEXT         NOT NULL,
+	mxc          VARCHAR(255) NOT NULL,
+
+	PRIMARY KEY (sender_type, sender_id)
+);
@@ -0,0 +1,20 @@
+-- v8: Track polls bridged between Matrix and Chatwoot and the votes on them
+
+CREATE TABLE matrix_poll (
+	poll_event_id   VARCHAR(255) PRIMARY KEY,
+	room_id         VARCHAR(255) NOT NULL,
+	sender          VARCHAR(255) NOT NULL,
+	question        TEXT         NOT NULL,
+	answers         TEXT         NOT NULL,
+	max_selections  INTEGER      NOT NULL,
+	from_chatwoot   BOOLEAN      NOT NULL
+);
+
+CREATE TABLE matrix_poll_vote (
+	poll_event_id  VARCHAR(255) NOT NULL,
+	user_id        VARCHAR(255) NOT NULL,
+	answers        TEXT         NOT NULL,
+	timestamp      BIGINT       NOT NULL,
+
+	PRIMARY KEY (poll_event_id, user_id)
+);
@@ -7,6 +7,8 @@ import (
 
 	"github.com/rs/zerolog"
 	"github.com/sethvargo/go-retry"
+
+	"github.com/beeper/chatwoot/chatwootapi"
 )
 
 func DoRetry[T any](ctx context.Context, description string, fn func(context.Context) (*T, error)) (*T, error) {
@@ -26,6 +28,9 @@ func DoRetry[T any](ctx context.Context, description string, fn func(context.Con
 			return val, nil
 		}
 		nextDuration, stop := b.Next()
+		if retryAfter := chatwootapi.RetryAfter(err); retryAfter > nextDuration {
+			nextDuration = retryAfter
+		}
 		attemptLogger.Info().Err(err).
 			Float64("retry_in_sec", nextDuration.Seconds()).
 			Msg("failed")
@@ -33,8 +38,16 @@ func DoRetry[T any](ctx context.Context, description string, fn func(context.Con
 			attemptLogger.Warn().Err(err).
 				Msg("failed. Retry limit reached. Will not retry.")
 			break
+		} else if !chatwootapi.IsTemporary(err) {
+			attemptLogger.Warn().Err(err).
+				Msg("failed with a permanent error. Will not retry.")
+			break
+		}
+		select {
+		case <-time.After(nextDuration):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		time.Sleep(nextDuration)
 	}
 	return nil, err
 }
@@ -56,6 +69,9 @@ func DoRetryArr[T any](ctx context.Context, description string, fn func(context.
 			return val, nil
 		}
 		nextDuration, stop := b.Next()
+		if retryAfter := chatwootapi.RetryAfter(err); retryAfter > nextDuration {
+			nextDuration = retryAfter
+		}
 		attemptLogger.Info().Err(err).
 			Float64("retry_in_sec", nextDuration.Seconds()).
 			Msg("failed")
@@ -63,8 +79,16 @@ func DoRetryArr[T any](ctx context.Context, description string, fn func(context.
 			attemptLogger.Warn().Err(err).
 				Msg("failed. Retry limit reached. Will not retry.")
 			break
+		} else if !chatwootapi.IsTemporary(err) {
+			attemptLogger.Warn().Err(err).
+				Msg("failed with a permanent error. Will not retry.")
+			break
+		}
+		select {
+		case <-time.After(nextDuration):
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
-		time.Sleep(nextDuration)
 	}
 	return nil, err
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+)
+
+// Extensible event keys (MSC3488) which clients use to render the location.
+const (
+	locationKey      = "org.matrix.msc3488.location"
+	locationAssetKey = "org.matrix.msc3488.asset"
+)
+
+// parseGeoURI parses the coordinates from a geo: URI (RFC 5870). The altitude
+// and the parameters of the URI are ignored.
+func parseGeoURI(uri string) (lat, long float64, err error) {
+	if !strings.HasPrefix(uri, "geo:") {
+		return 0, 0, fmt.Errorf("not a geo URI: %q", uri)
+	}
+	coordinates, _, _ := strings.Cut(strings.TrimPrefix(uri, "geo:"), ";")
+	parts := strings.Split(coordinates, ",")
+	if len(parts) < 2 {
+		return 0, 0, fmt.Errorf("geo URI %q doesn't have coordinates", uri)
+	}
+	if lat, err = strconv.ParseFloat(parts[0], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid latitude in geo URI %q: %w", uri, err)
+	}
+	if long, err = strconv.ParseFloat(parts[1], 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid longitude in geo URI %q: %w", uri, err)
+	}
+	if lat < -90 || lat > 90 || long < -180 || long > 180 {
+		return 0, 0, fmt.Errorf("coordinates in geo URI %q are out of range", uri)
+	}
+	return lat, long, nil
+}
+
+func formatCoordinate(coordinate float64) string {
+	return strconv.FormatFloat(coordinate, 'f', -1, 64)
+}
+
+func formatGeoURI(lat, long float64) string {
+	return fmt.Sprintf("geo:%s,%s", formatCoordinate(lat), formatCoordinate(long))
+}
+
+func mapLink(lat, long float64) string {
+	return fmt.Sprintf("https://www.openstreetmap.org/?mlat=%[1]s&mlon=%[2]s#map=16/%[1]s/%[2]s",
+		formatCoordinate(lat), formatCoordinate(long))
+}
+
+// matrixLocationToMarkdown renders a Matrix location as a Chatwoot message
+// with the coordinates and a link to a map.
+func matrixLocationToMarkdown(evt *event.Event, content *event.MessageEventContent) (string, error) {
+	geoURI := content.GeoURI
+	description := content.Body
+	if location, ok := evt.Content.Raw[locationKey].(map[string]any); ok {
+		if uri, ok := location["uri"].(string); ok && geoURI == "" {
+			geoURI = uri
+		}
+		if locationDescription, ok := location["description"].(string); ok && locationDescription != "" {
+			description = locationDescription
+		}
+	}
+	lat, long, err := parseGeoURI(geoURI)
+	if err != nil {
+		return "", err
+	}
+
+	// Clients often put the geo URI in the body if there is no description.
+	if strings.Contains(description, "geo:") {
+		description = ""
+	}
+	coordinates := fmt.Sprintf("%s, %s", formatCoordinate(lat), formatCoordinate(long))
+	if description == "" {
+		return fmt.Sprintf("**Location:** [%s](%s)", coordinates, mapLink(lat, long)), nil
+	}
+	return fmt.Sprintf("**Location:** %s\n\n[%s](%s)", description, coordinates, mapLink(lat, long)), nil
+}
+
+// handleLocationAttachment sends a Chatwoot location attachment as a Matrix
+// location.
+func handleLocationAttachment(ctx context.Context, sendAs *mautrix.Client, roomID id.RoomID, extraContent map[string]any, chatwootAttachment chatwootapi.Attachment, replyTo id.EventID) (*mautrix.RespSendEvent, error) {
+	lat, long := chatwootAttachment.CoordinatesLat, chatwootAttachment.CoordinatesLong
+	geoURI := formatGeoURI(lat, long)
+	description := chatwootAttachment.FallbackTitle
+	if description == "" {
+		description = fmt.Sprintf("%s, %s", formatCoordinate(lat), formatCoordinate(long))
+	}
+
+	content := &event.MessageEventContent{
+		MsgType: event.MsgLocation,
+		Body:    fmt.Sprintf("Location: %s (%s)", description, geoURI),
+		GeoURI:  geoURI,
+	}
+	if replyTo != "" {
+		content.RelatesTo = (&event.RelatesTo{}).SetReplyTo(replyTo)
+	}
+	extra := map[string]any{
+		"com.beeper.chatwoot.attachment_id": chatwootAttachment.ID,
+		locationKey: map[string]any{
+			"uri":         geoURI,
+			"description": description,
+		},
+		locationAssetKey: map[string]any{
+			"type": "m.pin",
+		},
+	}
+	for key, value := range extraContent {
+		extra[key] = value
+	}
+	return SendMessageAs(ctx, sendAs, roomID, content, extra)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/html"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/format"
+	"maunium.net/go/mautrix/id"
+)
+
+// matrixHTMLConverter converts Matrix HTML (org.matrix.custom.html) into the
+// markdown flavour that Chatwoot renders.
+type matrixHTMLConverter struct {
+	parser *format.HTMLParser
+
+	// userName returns a readable name for a user that was mentioned with a
+	// pill that didn't have any text of its own.
+	userName func(userID id.UserID) string
+}
+
+func newMatrixHTMLConverter(userName func(userID id.UserID) string) *matrixHTMLConverter {
+	converter := &matrixHTMLConverter{userName: userName}
+	converter.parser = &format.HTMLParser{
+		TabsToSpaces:   4,
+		Newline:        "\n",
+		HorizontalLine: "---",
+		PillConverter:  converter.convertPill,
+		BoldConverter: func(text string, _ format.Context) string {
+			return wrapInline(text, "**")
+		},
+		ItalicConverter: func(text string, _ format.Context) string {
+			return wrapInline(text, "*")
+		},
+		StrikethroughConverter: func(text string, _ format.Context) string {
+			return wrapInline(text, "~~")
+		},
+		// Chatwoot doesn't support underlines, so just keep the text.
+		UnderlineConverter: func(text string, _ format.Context) string {
+			return text
+		},
+		LinkConverter: func(text, href string, _ format.Context) string {
+			if text == "" || text == href {
+				return href
+			} else if "mailto:"+text == href {
+				return text
+			}
+			return fmt.Sprintf("[%s](%s)", text, href)
+		},
+		// Chatwoot doesn't support spoilers, and the agent needs to be able
+		// to read the message anyway.
+		SpoilerConverter: func(text, reason string, _ format.Context) string {
+			if reason != "" {
+				return fmt.Sprintf("*Spoiler (%s):* %s", reason, text)
+			}
+			return fmt.Sprintf("*Spoiler:* %s", text)
+		},
+	}
+	return converter
+}
+
+// wrapInline wraps the text in the given markdown delimiter. Markdown doesn't
+// allow whitespace directly inside of the delimiters, so it is moved outside.
+func wrapInline(text, delimiter string) string {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" {
+		return text
+	}
+	start := strings.Index(text, trimmed)
+	return text[:start] + delimiter + trimmed + delimiter + text[start+len(trimmed):]
+}
+
+func (c *matrixHTMLConverter) convertPill(displayname, mxid, eventID string, ctx format.Context) string {
+	if len(mxid) == 0 || mxid[0] != '@' {
+		return format.DefaultPillConverter(displayname, mxid, eventID, ctx)
+	}
+	if displayname != "" && displayname != mxid {
+		return displayname
+	}
+	if c.userName != nil {
+		return c.userName(id.UserID(mxid))
+	}
+	return mxid
+}
+
+// Convert converts the formatted body of a Matrix message into markdown.
+func (c *matrixHTMLConverter) Convert(formattedBody string) string {
+	doc, err := html.Parse(strings.NewReader(formattedBody))
+	if err != nil {
+		return c.parser.Parse(formattedBody, format.NewContext())
+	}
+	c.prepare(doc)
+
+	var buf strings.Builder
+	if err = html.Render(&buf, doc); err != nil {
+		return c.parser.Parse(formattedBody, format.NewContext())
+	}
+	return c.parser.Parse(buf.String(), format.NewContext())
+}
+
+// prepare rewrites the elements that the HTML parser doesn't know how to
+// handle: reply fallbacks are dropped, images are replaced with their alt
+// text and tables are rendered as markdown tables.
+func (c *matrixHTMLConverter) prepare(node *html.Node) {
+	for child := node.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type != html.ElementNode {
+			child = next
+			continue
+		}
+		switch child.Data {
+		case "mx-reply":
+			node.RemoveChild(child)
+		case "img":
+			node.InsertBefore(&html.Node{Type: html.TextNode, Data: imageAltText(child)}, child)
+			node.RemoveChild(child)
+		case "table":
+			c.renderTable(child)
+		default:
+			c.prepare(child)
+		}
+		child = next
+	}
+}
+
+func imageAltText(node *html.Node) string {
+	for _, key := range []string{"alt", "title"} {
+		for _, attr := range node.Attr {
+			if attr.Key == key && attr.Val != "" {
+				return attr.Val
+			}
+		}
+	}
+	return "image"
+}
+
+// renderTable replaces the contents of the table with the rows of a markdown
+// table separated by line breaks.
+func (c *matrixHTMLConverter) renderTable(table *html.Node) {
+	var rows [][]string
+	var walk func(node *html.Node)
+	walk = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.Data {
+			case "thead", "tbody", "tfoot":
+				walk(child)
+			case "tr":
+				var row []string
+				for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.Data == "td" || cell.Data == "th") {
+						row = append(row, c.renderTableCell(cell))
+					}
+				}
+				rows = append(rows, row)
+			}
+		}
+	}
+	walk(table)
+
+	for child := table.FirstChild; child != nil; child = table.FirstChild {
+		table.RemoveChild(child)
+	}
+	if len(rows) == 0 {
+		return
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+	separator := make([]string, columns)
+	for i := range separator {
+		separator[i] = "---"
+	}
+	lines := make([][]string, 0, len(rows)+1)
+	lines = append(lines, rows[0], separator)
+	lines = append(lines, rows[1:]...)
+
+	for i, cells := range lines {
+		for len(cells) < columns {
+			cells = append(cells, "")
+		}
+		if i > 0 {
+			table.AppendChild(&html.Node{Type: html.ElementNode, Data: "br"})
+		}
+		table.AppendChild(&html.Node{Type: html.TextNode, Data: "| " + strings.Join(cells, " | ") + " |"})
+	}
+}
+
+func (c *matrixHTMLConverter) renderTableCell(cell *html.Node) string {
+	var buf strings.Builder
+	for child := cell.FirstChild; child != nil; child = child.NextSibling {
+		if err := html.Render(&buf, child); err != nil {
+			return ""
+		}
+	}
+	text := c.Convert(buf.String())
+	text = strings.ReplaceAll(text, "\n", " ")
+	return strings.ReplaceAll(text, "|", "\\|")
+}
+
+// matrixMessageToMarkdown returns the text of the message as Chatwoot
+// markdown, converting the formatted body if there is one.
+func matrixMessageToMarkdown(roomID id.RoomID, content *event.MessageEventContent) string {
+	if content.Format != event.FormatHTML || content.FormattedBody == "" {
+		return content.Body
+	}
+	return newMatrixHTMLConverter(func(userID id.UserID) string {
+		return matrixUserDisplayName(roomID, userID)
+	}).Convert(content.FormattedBody)
+}
+
+// matrixUserDisplayName returns the display name of the user in the room,
+// falling back to the localpart of the user ID.
+func matrixUserDisplayName(roomID id.RoomID, userID id.UserID) string {
+	if client != nil && client.StateStore != nil {
+		if member := client.StateStore.GetMember(roomID, userID); member != nil && member.Displayname != "" {
+			return member.Displayname
+		}
+	}
+	if localpart, _, err := userID.Parse(); err == nil && localpart != "" {
+		return localpart
+	}
+	return userID.String()
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"maunium.net/go/mautrix/id"
+)
+
+var updateGolden = flag.Bool("update", false, "update the golden files")
+
+var testDisplayNames = map[id.UserID]string{
+	"@bob:example.com": "Bob",
+}
+
+// TestMatrixHTMLToMarkdown converts every testdata/matrix-html/*.html file
+// and compares the result with the corresponding .md file. Run the test with
+// -update to regenerate the .md files.
+func TestMatrixHTMLToMarkdown(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "matrix-html", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(inputs) == 0 {
+		t.Fatal("no golden files found")
+	}
+
+	converter := newMatrixHTMLConverter(func(userID id.UserID) string {
+		if name, ok := testDisplayNames[userID]; ok {
+			return name
+		}
+		return userID.String()
+	})
+
+	for _, input := range inputs {
+		input := input
+		name := strings.TrimSuffix(filepath.Base(input), ".html")
+		t.Run(name, func(t *testing.T) {
+			formattedBody, err := os.ReadFile(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			actual := converter.Convert(string(formattedBody)) + "\n"
+
+			goldenFile := strings.TrimSuffix(input, ".html") + ".md"
+			if *updateGolden {
+				if err = os.WriteFile(goldenFile, []byte(actual), 0644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			expected, err := os.ReadFile(goldenFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual != string(expected) {
+				t.Errorf("converted markdown doesn't match %s\n--- expected ---\n%s\n--- actual ---\n%s", goldenFile, expected, actual)
+			}
+		})
+	}
+}
@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"mime"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
@@ -38,8 +41,8 @@ func createChatwootConversation(ctx context.Context, roomID id.RoomID, contactMx
 		return conversationID, nil
 	}
 
-	contactID, err := chatwootAPI.ContactIDForMxid(contactMxid)
-	if err != nil {
+	contactID, err := chatwootAPI.ContactIDForMxid(ctx, contactMxid)
+	if errors.Is(err, chatwootapi.ErrNotFound) {
 		log.Warn().Err(err).Msg("contact ID not found for user, will attempt to create one")
 
 		contactID, err = chatwootAPI.CreateContact(ctx, contactMxid)
@@ -47,12 +50,14 @@ func createChatwootConversation(ctx context.Context, roomID id.RoomID, contactMx
 			return 0, fmt.Errorf("create contact failed for %s: %w", contactMxid, err)
 		}
 		log.Info().Int("contact_id", contactID).Msg("Contact created")
+	} else if err != nil {
+		return 0, fmt.Errorf("failed to search for contact for %s: %w", contactMxid, err)
 	}
 
 	log = log.With().Int("contact_id", contactID).Logger()
 
 	log.Info().Msg("creating Chatwoot conversation")
-	conversation, err := chatwootAPI.CreateConversation(roomID.String(), contactID, customAttrs)
+	conversation, err := chatwootAPI.CreateConversation(ctx, roomID.String(), contactID, customAttrs)
 	if err != nil {
 		return 0, fmt.Errorf("failed to create chatwoot conversation for %s: %w", roomID, err)
 	}
@@ -83,7 +88,7 @@ func createChatwootConversation(ctx context.Context, roomID id.RoomID, contactMx
 					time.Sleep(30 * time.Second)
 					log.Info().Msg("Adding canonical-dm label to conversation")
 
-					labels, err := chatwootAPI.GetConversationLabels(conversation.ID)
+					labels, err := chatwootAPI.GetConversationLabels(ctx, conversation.ID)
 					if err != nil {
 						log.Err(err).Msg("Failed to list conversation labels")
 					}
@@ -91,7 +96,7 @@ func createChatwootConversation(ctx context.Context, roomID id.RoomID, contactMx
 					labels = append(labels, "canonical-dm")
 
 					log.Info().Strs("labels", labels).Msg("Setting conversation labels")
-					err = chatwootAPI.SetConversationLabels(conversation.ID, labels)
+					err = chatwootAPI.SetConversationLabels(ctx, conversation.ID, labels)
 					if err != nil {
 						log.Err(err).Msg("failed to add canonical-dm label to conversation")
 					}
@@ -160,7 +165,7 @@ func HandleBeeperClientInfo(ctx context.Context, evt *event.Event) error {
 
 	deviceTypeKey, deviceVersion := GetCustomAttrForDevice(ctx, evt)
 	if deviceTypeKey != "" && deviceVersion != "" {
-		conv, err := chatwootAPI.GetChatwootConversation(conversationID)
+		conv, err := chatwootAPI.GetChatwootConversation(ctx, conversationID)
 		if err != nil {
 			log.Err(err).Msg("failed to get Chatwoot conversation")
 			return err
@@ -186,7 +191,7 @@ func HandleBeeperClientInfo(ctx context.Context, evt *event.Event) error {
 
 			log.Debug().Msg("setting device custom attribute on conversation")
 
-			err := chatwootAPI.SetConversationCustomAttributes(conversationID, customAttrs)
+			err := chatwootAPI.SetConversationCustomAttributes(ctx, conversationID, customAttrs)
 			if err != nil {
 				log.Err(err).Msg("failed to set device custom attribute on conversation")
 				return err
@@ -222,6 +227,10 @@ func HandleMessage(ctx context.Context, _ mautrix.EventSource, evt *event.Event)
 		log.Info().Interface("message_ids", messageIDs).Msg("event already has chatwoot messages")
 		return
 	}
+	if _, isStatusNotice := evt.Content.Raw[statusNoticeKey]; isStatusNotice {
+		log.Debug().Msg("not bridging conversation status notice")
+		return
+	}
 
 	conversationID, err := GetOrCreateChatwootConversation(ctx, evt.RoomID, evt)
 	if err != nil {
@@ -234,7 +243,10 @@ func HandleMessage(ctx context.Context, _ mautrix.EventSource, evt *event.Event)
 		messages, err := HandleMatrixMessageContent(ctx, evt, conversationID, content)
 		return messages, err
 	})
-	if err != nil {
+	if errors.Is(err, chatwootapi.ErrNotFound) {
+		log.Err(err).Int("conversation_id", conversationID).Msg("Chatwoot conversation no longer exists, not sending error message")
+		return
+	} else if err != nil {
 		DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, err), func(ctx context.Context) (*chatwootapi.Message, error) {
 			msg, err := chatwootAPI.SendPrivateMessage(
 				ctx,
@@ -251,6 +263,9 @@ func HandleMessage(ctx context.Context, _ mautrix.EventSource, evt *event.Event)
 	for _, m := range cm {
 		stateStore.SetChatwootMessageIdForMatrixEvent(ctx, evt.ID, m.ID)
 	}
+	if !isBridgeUser(evt.Sender) {
+		reopenConversation(ctx, evt.RoomID, conversationID)
+	}
 	content := evt.Content.AsMessage()
 	if content.MsgType == event.MsgText || content.MsgType == event.MsgNotice {
 		linearLinks := []string{}
@@ -272,6 +287,12 @@ func GetOrCreateChatwootConversation(ctx context.Context, roomID id.RoomID, evt
 	}
 
 	joinedMembers := client.StateStore.(*sqlstatestore.SQLStateStore).GetRoomMembers(roomID, event.MembershipJoin)
+	// The ghost users of agents aren't part of the conversation.
+	for userID := range joinedMembers {
+		if isGhostUser(userID) {
+			delete(joinedMembers, userID)
+		}
+	}
 	memberCount := len(joinedMembers)
 
 	if configuration.BridgeIfMembersLessThan >= 0 && memberCount >= configuration.BridgeIfMembersLessThan {
@@ -283,10 +304,10 @@ func GetOrCreateChatwootConversation(ctx context.Context, roomID id.RoomID, evt
 	}
 
 	contactMxid := evt.Sender
-	if configuration.Username == evt.Sender {
+	if isBridgeUser(evt.Sender) {
 		// This message came from the bot. Look for the other
 		// users in the room, and use them instead.
-		delete(joinedMembers, evt.Sender)
+		delete(joinedMembers, configuration.Username)
 		if len(joinedMembers) != 1 {
 			log.Warn().Msg("not creating Chatwoot conversation for non-DM room")
 			return -1, fmt.Errorf("not creating Chatwoot conversation for non-DM room")
@@ -337,24 +358,11 @@ func HandleReaction(ctx context.Context, _ mautrix.EventSource, evt *event.Event
 
 	cm, err := DoRetry(ctx, fmt.Sprintf("send notification of reaction to %d", conversationID), func(context.Context) (*chatwootapi.Message, error) {
 		reaction := evt.Content.AsReaction()
-		reactedEvent, err := client.GetEvent(evt.RoomID, reaction.RelatesTo.EventID)
+		reactedEvent, err := GetDecryptedEvent(evt.RoomID, reaction.RelatesTo.EventID)
 		if err != nil {
 			return nil, fmt.Errorf("couldn't find reacted to event %s: %w", reaction.RelatesTo.EventID, err)
 		}
 
-		if reactedEvent.Type == event.EventEncrypted {
-			err := reactedEvent.Content.ParseRaw(reactedEvent.Type)
-			if err != nil {
-				return nil, err
-			}
-
-			decryptedEvent, err := client.Crypto.Decrypt(reactedEvent)
-			if err != nil {
-				return nil, err
-			}
-			reactedEvent = decryptedEvent
-		}
-
 		reactedMessage := reactedEvent.Content.AsMessage()
 		var reactedMessageText string
 		switch reactedMessage.MsgType {
@@ -392,56 +400,62 @@ func HandleMatrixMessageContent(ctx context.Context, evt *event.Event, conversat
 	ctx = log.WithContext(ctx)
 
 	messageType := chatwootapi.IncomingMessage
-	if configuration.Username == evt.Sender {
+	if isBridgeUser(evt.Sender) {
 		messageType = chatwootapi.OutgoingMessage
 	}
 
+	// Stickers and polls don't have a message type.
+	switch evt.Type {
+	case event.EventSticker:
+		cm, err := handleMatrixSticker(ctx, evt, conversationID, content, messageType)
+		return []*chatwootapi.Message{cm}, err
+	case pollStartType, stablePollStartType:
+		return handleMatrixPollStart(ctx, evt, conversationID, messageType)
+	case pollResponseType, stablePollResponseType:
+		return handleMatrixPollResponse(ctx, evt, conversationID, messageType)
+	case pollEndType, stablePollEndType:
+		return handleMatrixPollEnd(ctx, evt, conversationID, messageType)
+	}
+
 	switch content.MsgType {
 	case event.MsgText, event.MsgNotice:
-		relatesTo := content.RelatesTo
-		body := content.Body
-		if relatesTo != nil && relatesTo.Type == event.RelReplace {
-			if strings.HasPrefix(body, " * ") {
-				body = " \\* " + body[3:]
+		if originalEventID := content.RelatesTo.GetReplaceID(); originalEventID != "" {
+			cm, err := handleMatrixEdit(ctx, evt, conversationID, originalEventID, content, messageType)
+			if cm == nil {
+				return nil, err
 			}
+			return []*chatwootapi.Message{cm}, err
+		}
+		content.RemoveReplyFallback()
+		body := matrixMessageToMarkdown(evt.RoomID, content)
+		if replyTo := content.RelatesTo.GetReplyTo(); replyTo != "" {
+			messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, replyTo)
+			if err == nil && len(messageIDs) > 0 {
+				cm, err := chatwootAPI.SendReplyMessage(ctx, conversationID, body, messageType, messageIDs[0])
+				return []*chatwootapi.Message{cm}, err
+			}
+			log.Debug().Str("reply_to", replyTo.String()).Msg("no Chatwoot message for replied to event, sending without reply")
 		}
 		cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, body, messageType)
 		return []*chatwootapi.Message{cm}, err
 
 	case event.MsgEmote:
+		content.RemoveReplyFallback()
 		localpart, _, _ := evt.Sender.Parse()
-		cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, fmt.Sprintf(" \\* %s %s", localpart, content.Body), messageType)
+		cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, fmt.Sprintf(" \\* %s %s", localpart, matrixMessageToMarkdown(evt.RoomID, content)), messageType)
 		return []*chatwootapi.Message{cm}, err
 
 	case event.MsgAudio, event.MsgFile, event.MsgImage, event.MsgVideo:
-		var file *event.EncryptedFileInfo
-		rawMXC := content.URL
-		if content.File != nil {
-			file = content.File
-			rawMXC = file.URL
-		}
-		mxc, err := rawMXC.Parse()
+		data, err := downloadMatrixMedia(evt, content)
 		if err != nil {
-			return nil, fmt.Errorf("malformed content URL in %s: %w", evt.ID, err)
-		}
-
-		data, err := client.DownloadBytes(mxc)
-		if err != nil {
-			return nil, fmt.Errorf("failed to download media in %s: %w", evt.ID, err)
-		}
-
-		if file != nil {
-			err = file.DecryptInPlace(data)
-			if err != nil {
-				return nil, fmt.Errorf("failed to decrypt media in %s: %w", evt.ID, err)
-			}
+			return nil, err
 		}
 
 		filename := content.Body
 		caption := ""
 		if content.FileName != "" {
 			filename = content.FileName
-			caption = content.Body
+			caption = matrixMessageToMarkdown(evt.RoomID, content)
 		}
 
 		mimeType := "application/octet-stream"
@@ -449,7 +463,19 @@ func HandleMatrixMessageContent(ctx context.Context, evt *event.Event, conversat
 			mimeType = content.Info.MimeType
 		}
 
-		cm, err := chatwootAPI.SendAttachmentMessage(conversationID, filename, mimeType, bytes.NewReader(data), messageType)
+		// The body of voice messages is just "Voice message", so the
+		// duration is sent instead.
+		text := ""
+		if isVoiceMessage(evt, content) {
+			filename = voiceMessageFilename(mimeType)
+			caption = ""
+			text = "Voice message"
+			if duration := voiceMessageDuration(evt, content, data); duration > 0 {
+				text = fmt.Sprintf("Voice message (%s)", formatDuration(duration))
+			}
+		}
+
+		cm, err := chatwootAPI.SendAttachmentMessageWithContent(ctx, conversationID, text, filename, mimeType, bytes.NewReader(data), messageType)
 		if err != nil {
 			return nil, fmt.Errorf("failed to send attachment message. Error: %w", err)
 		}
@@ -466,11 +492,71 @@ func HandleMatrixMessageContent(ctx context.Context, evt *event.Event, conversat
 
 		return messages, err
 
+	case event.MsgLocation:
+		body, err := matrixLocationToMarkdown(evt, content)
+		if err != nil {
+			return nil, fmt.Errorf("invalid location in %s: %w", evt.ID, err)
+		}
+		cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, body, messageType)
+		return []*chatwootapi.Message{cm}, err
+
 	default:
 		return nil, fmt.Errorf("unsupported message type %s in %s", content.MsgType, evt.ID)
 	}
 }
 
+// downloadMatrixMedia downloads the media of the message and decrypts it if
+// necessary.
+func downloadMatrixMedia(evt *event.Event, content *event.MessageEventContent) ([]byte, error) {
+	var file *event.EncryptedFileInfo
+	rawMXC := content.URL
+	if content.File != nil {
+		file = content.File
+		rawMXC = file.URL
+	}
+	mxc, err := rawMXC.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("malformed content URL in %s: %w", evt.ID, err)
+	}
+
+	data, err := client.DownloadBytes(mxc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download media in %s: %w", evt.ID, err)
+	}
+
+	if file != nil {
+		err = file.DecryptInPlace(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt media in %s: %w", evt.ID, err)
+		}
+	}
+	return data, nil
+}
+
+// handleMatrixSticker sends the sticker to Chatwoot as an image with the body
+// of the sticker as the text of the message.
+func handleMatrixSticker(ctx context.Context, evt *event.Event, conversationID int, content *event.MessageEventContent, messageType chatwootapi.MessageType) (*chatwootapi.Message, error) {
+	data, err := downloadMatrixMedia(evt, content)
+	if err != nil {
+		return nil, err
+	}
+
+	mimeType := http.DetectContentType(data)
+	if content.Info != nil && content.Info.MimeType != "" {
+		mimeType = content.Info.MimeType
+	}
+	filename := "sticker"
+	if extensions, err := mime.ExtensionsByType(mimeType); err == nil && len(extensions) > 0 {
+		filename += extensions[0]
+	}
+
+	cm, err := chatwootAPI.SendAttachmentMessageWithContent(ctx, conversationID, content.Body, filename, mimeType, bytes.NewReader(data), messageType)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send sticker message: %w", err)
+	}
+	return cm, nil
+}
+
 func HandleRedaction(ctx context.Context, _ mautrix.EventSource, evt *event.Event) {
 	log := zerolog.Ctx(ctx).With().
 		Str("room_id", evt.RoomID.String()).
@@ -489,9 +575,24 @@ func HandleRedaction(ctx context.Context, _ mautrix.EventSource, evt *event.Even
 	defer log.Debug().Msg("released send lock")
 	defer roomSendlocks[evt.RoomID].Unlock()
 
-	messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, evt.ID)
+	// Redactions sent by the bot are from messages deleted in Chatwoot.
+	if isBridgeUser(evt.Sender) {
+		log.Debug().Msg("ignoring redaction sent by the bot")
+		return
+	}
+
+	redaction := evt.Content.AsRedaction()
+	redacts := evt.Redacts
+	if contentRedacts, ok := evt.Content.Raw["redacts"].(string); ok && redacts == "" {
+		// Since room v11, the redacted event ID is in the content.
+		redacts = id.EventID(contentRedacts)
+	}
+	log = log.With().Str("redacts", redacts.String()).Logger()
+	ctx = log.WithContext(ctx)
+
+	messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, redacts)
 	if err != nil || len(messageIDs) == 0 {
-		log.Err(err).Str("redacts", evt.Redacts.String()).Msg("no Chatwoot message for redacted event")
+		log.Err(err).Msg("no Chatwoot message for redacted event")
 		return
 	}
 
@@ -501,10 +602,281 @@ func HandleRedaction(ctx context.Context, _ mautrix.EventSource, evt *event.Even
 		return
 	}
 
+	// This also removes the "reacted with" message when a reaction is
+	// removed since it is mapped to the reaction event.
+	var errs []error
 	for _, messageID := range messageIDs {
-		err = chatwootAPI.DeleteMessage(conversationID, messageID)
+		err = chatwootAPI.DeleteMessage(ctx, conversationID, messageID)
 		if err != nil {
-			log.Err(err).Msg("failed to delete Chatwoot message")
+			log.Err(err).Int("message_id", messageID).Msg("failed to delete Chatwoot message")
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		DoRetry(ctx, fmt.Sprintf("send private error message to %d for %+v", conversationID, errs), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(
+				ctx,
+				conversationID,
+				fmt.Sprintf("**Error occurred while deleting a message that was redacted in Matrix. The message may still be visible!**\n\nError: %+v", errs))
+		})
+	}
+
+	if redaction.Reason != "" {
+		DoRetry(ctx, fmt.Sprintf("send redaction reason to %d", conversationID), func(ctx context.Context) (*chatwootapi.Message, error) {
+			return chatwootAPI.SendPrivateMessage(
+				ctx,
+				conversationID,
+				fmt.Sprintf("%s deleted a message. Reason: %s", evt.Sender, redaction.Reason))
+		})
+	}
+}
+
+var typingLock sync.Mutex
+var contactTypingInRoom = map[id.RoomID]bool{}
+
+func HandleTyping(ctx context.Context, _ mautrix.EventSource, evt *event.Event) {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "handle_typing").
+		Str("room_id", evt.RoomID.String()).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	// Typing is set through the client API so that Chatwoot shows the contact
+	// typing instead of the bot's agent.
+	if chatwootAPI.InboxIdentifier == "" {
+		return
+	}
+
+	typing := false
+	for _, userID := range evt.Content.AsTyping().UserIDs {
+		if !isBridgeUser(userID) && VerifyFromAuthorizedUser(userID) {
+			typing = true
+			break
 		}
 	}
+
+	typingLock.Lock()
+	changed := contactTypingInRoom[evt.RoomID] != typing
+	contactTypingInRoom[evt.RoomID] = typing
+	typingLock.Unlock()
+	if !changed {
+		return
+	}
+
+	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
+	if err != nil {
+		log.Debug().Err(err).Msg("no Chatwoot conversation associated with room")
+		return
+	}
+
+	log.Debug().Bool("typing", typing).Int("conversation_id", conversationID).Msg("setting typing status in Chatwoot")
+	// The conversation was created with the room ID as the source ID of the
+	// contact inbox.
+	err = chatwootAPI.ToggleContactTypingStatus(ctx, evt.RoomID.String(), conversationID, typing)
+	if err != nil {
+		log.Err(err).Msg("failed to set typing status in Chatwoot")
+	}
+}
+
+func HandleReceipt(ctx context.Context, _ mautrix.EventSource, evt *event.Event) {
+	log := zerolog.Ctx(ctx).With().
+		Str("component", "handle_receipt").
+		Str("room_id", evt.RoomID.String()).
+		Logger()
+	ctx = log.WithContext(ctx)
+
+	conversationID, err := stateStore.GetChatwootConversationIDFromMatrixRoom(ctx, evt.RoomID)
+	if err != nil {
+		log.Debug().Err(err).Msg("no Chatwoot conversation associated with room")
+		return
+	}
+
+	// Find the most recent Chatwoot message that the contact has read.
+	maxMessageID := 0
+	for eventID, receipts := range *evt.Content.AsReceipt() {
+		contactRead := false
+		for userID := range receipts[event.ReceiptTypeRead] {
+			if !isBridgeUser(userID) && VerifyFromAuthorizedUser(userID) {
+				contactRead = true
+				break
+			}
+		}
+		if !contactRead {
+			continue
+		}
+
+		for _, messageID := range receiptChatwootMessageIDs(ctx, evt.RoomID, eventID) {
+			if messageID > maxMessageID {
+				maxMessageID = messageID
+			}
+		}
+	}
+	if maxMessageID == 0 {
+		return
+	}
+
+	// Chatwoot message IDs are increasing, so reading a message means that
+	// all of the previous messages were read as well.
+	messageIDs, err := stateStore.GetChatwootMessagesWithDeliveryStatus(ctx, conversationID, string(chatwootapi.MessageStatusDelivered), maxMessageID)
+	if err != nil {
+		log.Err(err).Msg("failed to get delivered Chatwoot messages")
+		return
+	}
+	for _, messageID := range messageIDs {
+		log.Debug().Int("message_id", messageID).Msg("marking Chatwoot message as read")
+		setMessageStatus(ctx, conversationID, messageID, chatwootapi.MessageStatusRead, "")
+	}
+}
+
+// receiptContextLimit is the number of events around a receipted event that
+// are searched for the latest message bridged to or from Chatwoot.
+const receiptContextLimit = 40
+
+// receiptChatwootMessageIDs returns the Chatwoot messages of the receipted
+// event. If the event isn't bridged (for example, a conversation status
+// notice), the messages of the latest bridged event before it are returned,
+// since reading an event means that the previous events were read as well.
+func receiptChatwootMessageIDs(ctx context.Context, roomID id.RoomID, eventID id.EventID) []int {
+	log := zerolog.Ctx(ctx).With().Str("receipt_event_id", eventID.String()).Logger()
+
+	messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, eventID)
+	if err == nil && len(messageIDs) > 0 {
+		return messageIDs
+	}
+	resp, err := client.Context(roomID, eventID, nil, receiptContextLimit)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get the events before the receipted event")
+		return nil
+	}
+	// The events before the receipted event are in reverse chronological
+	// order.
+	for _, previousEvent := range resp.EventsBefore {
+		messageIDs, err = stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, previousEvent.ID)
+		if err == nil && len(messageIDs) > 0 {
+			log.Debug().Str("bridged_event_id", previousEvent.ID.String()).Msg("using the latest bridged event before the receipted event")
+			return messageIDs
+		}
+	}
+	return nil
+}
+
+// reopenConversation opens the conversation if it is resolved or snoozed so
+// that agents see the new message from the user.
+func reopenConversation(ctx context.Context, roomID id.RoomID, conversationID int) {
+	log := zerolog.Ctx(ctx).With().Int("conversation_id", conversationID).Logger()
+
+	status, err := stateStore.GetConversationStatusForRoom(ctx, roomID)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get conversation status")
+		return
+	}
+	if status != string(chatwootapi.ConversationStatusResolved) && status != string(chatwootapi.ConversationStatusSnoozed) {
+		return
+	}
+
+	log.Info().Str("previous_status", status).Msg("reopening conversation because of new message")
+	err = chatwootAPI.ToggleStatus(ctx, conversationID, chatwootapi.ConversationStatusOpen)
+	if err != nil {
+		log.Err(err).Msg("failed to reopen conversation")
+		return
+	}
+	err = stateStore.UpdateConversationStatus(ctx, conversationID, string(chatwootapi.ConversationStatusOpen))
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to store conversation status")
+	}
+}
+
+// GetDecryptedEvent gets the event from the homeserver, decrypting it if
+// necessary.
+func GetDecryptedEvent(roomID id.RoomID, eventID id.EventID) (*event.Event, error) {
+	evt, err := client.GetEvent(roomID, eventID)
+	if err != nil {
+		return nil, err
+	}
+	err = evt.Content.ParseRaw(evt.Type)
+	if err != nil && !errors.Is(err, event.ErrContentAlreadyParsed) {
+		return nil, err
+	}
+	if evt.Type == event.EventEncrypted {
+		if client.Crypto == nil {
+			return nil, errors.New("can't decrypt event because encryption is not initialized")
+		}
+		return client.Crypto.Decrypt(evt)
+	}
+	return evt, nil
+}
+
+// handleMatrixEdit updates the Chatwoot message in place if Chatwoot allows
+// it. Otherwise, it sends a new message which quotes the previous text and
+// replies to the original message. Only the new message is returned, since
+// the edit event must not be mapped to the original message: redacting the
+// edit would otherwise delete the original message in Chatwoot.
+func handleMatrixEdit(ctx context.Context, evt *event.Event, conversationID int, originalEventID id.EventID, content *event.MessageEventContent, messageType chatwootapi.MessageType) (*chatwootapi.Message, error) {
+	log := zerolog.Ctx(ctx).With().
+		Str("original_event_id", originalEventID.String()).
+		Logger()
+
+	newBody := strings.TrimPrefix(content.Body, "* ")
+	if content.NewContent != nil {
+		newBody = matrixMessageToMarkdown(evt.RoomID, content.NewContent)
+	}
+
+	messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, originalEventID)
+	if err != nil || len(messageIDs) == 0 {
+		log.Warn().Err(err).Msg("no Chatwoot message found for edited event, sending as new message")
+		return chatwootAPI.SendTextMessage(ctx, conversationID, fmt.Sprintf("**Edited message**\n\n%s", newBody), messageType)
+	}
+	originalMessageID := messageIDs[0]
+	log = log.With().Int("original_message_id", originalMessageID).Logger()
+
+	// Find the text before this edit.
+	previousBody, err := stateStore.GetLatestMatrixEventEditBody(ctx, originalEventID)
+	if err != nil {
+		log.Warn().Err(err).Msg("failed to get previous edit of event")
+	}
+	if previousBody == "" {
+		originalEvent, err := GetDecryptedEvent(evt.RoomID, originalEventID)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to get original event")
+		} else {
+			originalContent := originalEvent.Content.AsMessage()
+			originalContent.RemoveReplyFallback()
+			previousBody = matrixMessageToMarkdown(evt.RoomID, originalContent)
+		}
+	}
+
+	// The edit is only stored once it reached Chatwoot, so that retries still
+	// quote the text before the edit.
+	storeEdit := func() {
+		err := stateStore.AddMatrixEventEdit(ctx, originalEventID, evt.ID, newBody, evt.Timestamp)
+		if err != nil {
+			log.Warn().Err(err).Msg("failed to store edit")
+		}
+	}
+
+	updated, err := chatwootAPI.UpdateMessageContent(ctx, conversationID, originalMessageID, newBody)
+	if err == nil && updated.Content != nil && *updated.Content == newBody {
+		log.Info().Msg("updated Chatwoot message in place")
+		storeEdit()
+		return nil, nil
+	}
+	log.Debug().Err(err).Msg("couldn't update Chatwoot message in place, sending edited message")
+
+	var editText strings.Builder
+	editText.WriteString("**Edited message**\n\n")
+	if previousBody != "" {
+		for _, line := range strings.Split(previousBody, "\n") {
+			editText.WriteString("> ")
+			editText.WriteString(line)
+			editText.WriteString("\n")
+		}
+		editText.WriteString("\n")
+	}
+	editText.WriteString(newBody)
+	sent, err := chatwootAPI.SendReplyMessage(ctx, conversationID, editText.String(), messageType, originalMessageID)
+	if err != nil {
+		return nil, err
+	}
+	storeEdit()
+	return sent, nil
 }
@@ -0,0 +1,55 @@
+// Package media extracts metadata such as the duration of audio and video
+// files and the dimensions of videos from their container headers without
+// decoding the media.
+package media
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"time"
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported media format")
+
+// Info is the metadata of a media file. Fields that couldn't be determined
+// are left empty.
+type Info struct {
+	MimeType string
+	Codec    string
+	Duration time.Duration
+
+	// Width and Height are the dimensions of the first video track.
+	Width  int
+	Height int
+
+	// Thumbnail is a JPEG or PNG image embedded in the container, such as
+	// cover art. Frames of the video itself are never extracted, as that
+	// would need a video decoder.
+	Thumbnail []byte
+
+	// Waveform is an estimate of the loudness of the audio with values
+	// between 0 and 1024 (MSC3246). It is only set for Opus audio.
+	Waveform []int
+}
+
+// IsVideo returns whether the file has a video track.
+func (info *Info) IsVideo() bool {
+	return strings.HasPrefix(info.MimeType, "video/")
+}
+
+// Parse detects the container format of the data and extracts the metadata.
+func Parse(data []byte) (*Info, error) {
+	switch {
+	case bytes.HasPrefix(data, oggCapturePattern):
+		return ParseOgg(data)
+	case len(data) >= 12 && bytes.Equal(data[0:4], []byte("RIFF")) && bytes.Equal(data[8:12], []byte("WAVE")):
+		return ParseWAV(data)
+	case isMP4(data):
+		return ParseMP4(data)
+	case bytes.HasPrefix(data, ebmlMagic):
+		return ParseWebM(data)
+	default:
+		return nil, ErrUnsupportedFormat
+	}
+}
@@ -0,0 +1,40 @@
+package media
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func assertInfo(t *testing.T, actual *Info, expected Info) {
+	t.Helper()
+	if actual.MimeType != expected.MimeType ||
+		actual.Codec != expected.Codec ||
+		actual.Duration != expected.Duration ||
+		actual.Width != expected.Width ||
+		actual.Height != expected.Height ||
+		!bytes.Equal(actual.Thumbnail, expected.Thumbnail) ||
+		!equalWaveforms(actual.Waveform, expected.Waveform) {
+		t.Errorf("unexpected media info\nexpected: %+v\nactual:   %+v", expected, *actual)
+	}
+}
+
+func equalWaveforms(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestParseUnsupportedFormat(t *testing.T) {
+	for _, data := range [][]byte{nil, []byte("GIF89a"), []byte("RIFF\x00\x00\x00\x00AVI ")} {
+		if _, err := Parse(data); !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("expected ErrUnsupportedFormat for %q, got %v", data, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+type mp4Box struct {
+	boxType string
+	body    []byte
+}
+
+// readMP4Boxes splits the data into ISO base media file format boxes.
+func readMP4Boxes(data []byte) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, errors.New("truncated mp4 box header")
+		}
+		size := uint64(binary.BigEndian.Uint32(data[0:4]))
+		boxType := string(data[4:8])
+		headerSize := uint64(8)
+		switch size {
+		case 0:
+			// The box extends to the end of the file.
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return nil, errors.New("truncated mp4 box header")
+			}
+			size = binary.BigEndian.Uint64(data[8:16])
+			headerSize = 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return nil, errors.New("invalid mp4 box size")
+		}
+		boxes = append(boxes, mp4Box{boxType: boxType, body: data[headerSize:size]})
+		data = data[size:]
+	}
+	return boxes, nil
+}
+
+// findMP4Box returns the first box with the given path of box types.
+func findMP4Box(data []byte, path ...string) (*mp4Box, bool) {
+	boxes, err := readMP4Boxes(data)
+	if err != nil {
+		return nil, false
+	}
+	for _, box := range boxes {
+		if box.boxType != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return &box, true
+		}
+		return findMP4Box(box.body, path[1:]...)
+	}
+	return nil, false
+}
+
+func isMP4(data []byte) bool {
+	return len(data) >= 8 && string(data[4:8]) == "ftyp"
+}
+
+// ParseMP4 reads the duration from the movie header and the dimensions and
+// codecs from the track headers of an MP4 (or QuickTime) file. Cover art is
+// used as the thumbnail if there is any.
+func ParseMP4(data []byte) (*Info, error) {
+	if !isMP4(data) {
+		return nil, ErrUnsupportedFormat
+	}
+	moov, ok := findMP4Box(data, "moov")
+	if !ok {
+		return nil, errors.New("mp4 file doesn't have a moov box")
+	}
+	info := &Info{MimeType: "audio/mp4"}
+
+	if mvhd, ok := findMP4Box(moov.body, "mvhd"); ok {
+		info.Duration = mp4HeaderDuration(mvhd.body)
+	}
+
+	boxes, err := readMP4Boxes(moov.body)
+	if err != nil {
+		return nil, err
+	}
+	for _, trak := range boxes {
+		if trak.boxType != "trak" {
+			continue
+		}
+		hdlr, ok := findMP4Box(trak.body, "mdia", "hdlr")
+		// The handler type comes after the version, flags and pre-defined
+		// fields.
+		if !ok || len(hdlr.body) < 12 {
+			continue
+		}
+		handlerType := string(hdlr.body[8:12])
+		if handlerType != "vide" && handlerType != "soun" {
+			continue
+		}
+		codec := ""
+		// The sample description box has the version, flags and entry
+		// count before the first sample entry.
+		if stsd, ok := findMP4Box(trak.body, "mdia", "minf", "stbl", "stsd"); ok && len(stsd.body) >= 16 {
+			codec = string(stsd.body[12:16])
+		}
+
+		if handlerType == "vide" && info.Width == 0 {
+			info.MimeType = "video/mp4"
+			info.Codec = codec
+			if tkhd, ok := findMP4Box(trak.body, "tkhd"); ok && len(tkhd.body) >= 8 {
+				// The width and height are 16.16 fixed-point numbers at the
+				// end of the track header.
+				info.Width = int(binary.BigEndian.Uint32(tkhd.body[len(tkhd.body)-8:]) >> 16)
+				info.Height = int(binary.BigEndian.Uint32(tkhd.body[len(tkhd.body)-4:]) >> 16)
+			}
+		} else if handlerType == "soun" && info.Codec == "" {
+			info.Codec = codec
+		}
+	}
+
+	info.Thumbnail = mp4CoverArt(moov.body)
+	return info, nil
+}
+
+// mp4HeaderDuration reads the duration from a movie header box.
+func mp4HeaderDuration(mvhd []byte) time.Duration {
+	if len(mvhd) < 1 {
+		return 0
+	}
+	var timescale, duration uint64
+	if mvhd[0] == 1 {
+		if len(mvhd) < 32 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[20:24]))
+		duration = binary.BigEndian.Uint64(mvhd[24:32])
+	} else {
+		if len(mvhd) < 20 {
+			return 0
+		}
+		timescale = uint64(binary.BigEndian.Uint32(mvhd[12:16]))
+		duration = uint64(binary.BigEndian.Uint32(mvhd[16:20]))
+	}
+	if timescale == 0 {
+		return 0
+	}
+	seconds := duration / timescale
+	remainder := duration % timescale
+	return time.Duration(seconds)*time.Second + time.Duration(remainder*uint64(time.Second)/timescale)
+}
+
+// mp4CoverArt returns the cover art image from the iTunes metadata, if any.
+func mp4CoverArt(moov []byte) []byte {
+	meta, ok := findMP4Box(moov, "udta", "meta")
+	// The meta box is a full box, so it has the version and flags first.
+	if !ok || len(meta.body) < 4 {
+		return nil
+	}
+	data, ok := findMP4Box(meta.body[4:], "ilst", "covr", "data")
+	// The data box has the type and locale before the image.
+	if !ok || len(data.body) < 8 {
+		return nil
+	}
+	image := data.body[8:]
+	if !bytes.HasPrefix(image, []byte("\xff\xd8")) && !bytes.HasPrefix(image, []byte("\x89PNG")) {
+		return nil
+	}
+	return image
+}
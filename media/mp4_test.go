@@ -0,0 +1,196 @@
+package media
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func buildMP4Box(boxType string, children ...[]byte) []byte {
+	body := concat(children...)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box[0:4], uint32(8+len(body)))
+	copy(box[4:8], boxType)
+	return append(box, body...)
+}
+
+// buildMP4LargeBox builds a box with a 64-bit size.
+func buildMP4LargeBox(boxType string, children ...[]byte) []byte {
+	body := concat(children...)
+	box := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint32(box[0:4], 1)
+	copy(box[4:8], boxType)
+	binary.BigEndian.PutUint64(box[8:16], uint64(16+len(body)))
+	return append(box, body...)
+}
+
+func mp4MovieHeader(version byte, timescale uint32, duration uint64) []byte {
+	if version == 1 {
+		mvhd := make([]byte, 112)
+		mvhd[0] = 1
+		binary.BigEndian.PutUint32(mvhd[20:24], timescale)
+		binary.BigEndian.PutUint64(mvhd[24:32], duration)
+		return buildMP4Box("mvhd", mvhd)
+	}
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:16], timescale)
+	binary.BigEndian.PutUint32(mvhd[16:20], uint32(duration))
+	return buildMP4Box("mvhd", mvhd)
+}
+
+func mp4Track(handlerType, codec string, width, height uint32) []byte {
+	tkhd := make([]byte, 84)
+	binary.BigEndian.PutUint32(tkhd[76:80], width<<16)
+	binary.BigEndian.PutUint32(tkhd[80:84], height<<16)
+	hdlr := concat(make([]byte, 8), []byte(handlerType), make([]byte, 13))
+	stsd := concat([]byte{0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 16}, []byte(codec), make([]byte, 8))
+	return buildMP4Box("trak",
+		buildMP4Box("tkhd", tkhd),
+		buildMP4Box("mdia",
+			buildMP4Box("hdlr", hdlr),
+			buildMP4Box("minf", buildMP4Box("stbl", buildMP4Box("stsd", stsd))),
+		),
+	)
+}
+
+func mp4CoverArtMetadata(image []byte) []byte {
+	return buildMP4Box("udta",
+		buildMP4Box("meta",
+			make([]byte, 4),
+			buildMP4Box("ilst", buildMP4Box("covr", buildMP4Box("data", make([]byte, 8), image))),
+		),
+	)
+}
+
+var (
+	testJPEG = []byte("\xff\xd8\xff\xe0fake jpeg")
+	testPNG  = []byte("\x89PNG\r\n\x1a\nfake png")
+)
+
+func TestParseMP4(t *testing.T) {
+	ftyp := buildMP4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2avc1mp41"))
+	tests := []struct {
+		name     string
+		data     []byte
+		expected Info
+	}{
+		{
+			name: "video with audio",
+			data: concat(ftyp, buildMP4Box("moov",
+				mp4MovieHeader(0, 1000, 12500),
+				mp4Track("soun", "mp4a", 0, 0),
+				mp4Track("vide", "avc1", 1280, 720),
+			)),
+			expected: Info{MimeType: "video/mp4", Codec: "avc1", Duration: 12500 * time.Millisecond, Width: 1280, Height: 720},
+		},
+		{
+			name: "audio only",
+			data: concat(ftyp, buildMP4Box("moov",
+				mp4MovieHeader(0, 44100, 44100*3/2),
+				mp4Track("soun", "mp4a", 0, 0),
+			)),
+			expected: Info{MimeType: "audio/mp4", Codec: "mp4a", Duration: 1500 * time.Millisecond},
+		},
+		{
+			name: "moov after mdat with 64-bit sizes",
+			data: concat(ftyp, buildMP4LargeBox("mdat", make([]byte, 32)), buildMP4LargeBox("moov",
+				mp4MovieHeader(1, 600, 600*90),
+				mp4Track("vide", "hvc1", 3840, 2160),
+			)),
+			expected: Info{MimeType: "video/mp4", Codec: "hvc1", Duration: 90 * time.Second, Width: 3840, Height: 2160},
+		},
+		{
+			name: "jpeg cover art",
+			data: concat(ftyp, buildMP4Box("moov",
+				mp4MovieHeader(0, 1000, 1000),
+				mp4Track("vide", "avc1", 640, 480),
+				mp4CoverArtMetadata(testJPEG),
+			)),
+			expected: Info{MimeType: "video/mp4", Codec: "avc1", Duration: time.Second, Width: 640, Height: 480, Thumbnail: testJPEG},
+		},
+		{
+			name: "png cover art",
+			data: concat(ftyp, buildMP4Box("moov",
+				mp4MovieHeader(0, 1000, 1000),
+				mp4Track("soun", "mp4a", 0, 0),
+				mp4CoverArtMetadata(testPNG),
+			)),
+			expected: Info{MimeType: "audio/mp4", Codec: "mp4a", Duration: time.Second, Thumbnail: testPNG},
+		},
+		{
+			name: "cover art that isn't an image",
+			data: concat(ftyp, buildMP4Box("moov",
+				mp4MovieHeader(0, 1000, 1000),
+				mp4CoverArtMetadata([]byte("not an image")),
+			)),
+			expected: Info{MimeType: "audio/mp4", Duration: time.Second},
+		},
+		{
+			name:     "zero timescale",
+			data:     concat(ftyp, buildMP4Box("moov", mp4MovieHeader(0, 0, 1000))),
+			expected: Info{MimeType: "audio/mp4"},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			info, err := Parse(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertInfo(t, info, test.expected)
+		})
+	}
+}
+
+func TestParseMP4Errors(t *testing.T) {
+	ftyp := buildMP4Box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	badSize := buildMP4Box("moov", mp4MovieHeader(0, 1000, 1000))
+	binary.BigEndian.PutUint32(badSize[0:4], 4)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no moov box", concat(ftyp, buildMP4Box("mdat", make([]byte, 16)))},
+		{"box size smaller than header", concat(ftyp, badSize)},
+		{"truncated moov box", concat(ftyp, buildMP4Box("moov", mp4MovieHeader(0, 1000, 1000)))[:len(ftyp)+20]},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if info, err := Parse(test.data); err == nil {
+				t.Errorf("expected an error, got %+v", info)
+			}
+		})
+	}
+}
+
+// TestParseTruncated checks that the parsers don't panic on files that are
+// cut off at any point.
+func TestParseTruncated(t *testing.T) {
+	ftyp := buildMP4Box("ftyp", []byte("isom\x00\x00\x02\x00"))
+	files := map[string][]byte{
+		"mp4": concat(ftyp, buildMP4Box("moov",
+			mp4MovieHeader(1, 1000, 1000),
+			mp4Track("vide", "avc1", 640, 480),
+			mp4CoverArtMetadata(testJPEG),
+		)),
+		"webm": buildTestWebM(),
+		"wav":  buildWAV(1000, buildWAVChunk("data", make([]byte, 10))),
+		"ogg": concat(
+			buildOggPage(oggHeaderTypeBOS, 0, 1, theoraHeader(640, 360, 25, 6)),
+			buildOggPage(oggHeaderTypeBOS, 0, 2, opusHeader(0)),
+			buildOggPage(0, 48000, 2, make([]byte, 10)),
+		),
+	}
+	for name, data := range files {
+		for length := 0; length < len(data); length++ {
+			// Only the lack of panics matters here.
+			_, _ = Parse(data[:length])
+		}
+		if _, err := Parse(data); err != nil {
+			t.Errorf("failed to parse complete %s file: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+var oggCapturePattern = []byte("OggS")
+
+const (
+	oggPageHeaderSize = 27
+	oggHeaderTypeBOS  = 0x02
+	// Limits that keep crafted files from using too much memory and time.
+	// Real files have a few streams and pages of several kilobytes.
+	maxOggPages   = 1 << 17
+	maxOggStreams = 16
+	// Opus granule positions are always in 48 kHz samples.
+	opusSampleRate = 48000
+	// The number of values in the waveform, which is what clients expect.
+	waveformLength = 100
+	waveformMax    = 1024
+)
+
+type oggPage struct {
+	headerType byte
+	granule    int64
+	serial     uint32
+	segments   []byte
+	body       []byte
+}
+
+// readOggPages splits the data into Ogg pages. The checksums of the pages are
+// not verified.
+func readOggPages(data []byte) ([]oggPage, error) {
+	var pages []oggPage
+	for len(data) > 0 {
+		if len(pages) >= maxOggPages {
+			return nil, errors.New("ogg file has too many pages")
+		}
+		if len(data) < oggPageHeaderSize || !bytes.HasPrefix(data, oggCapturePattern) {
+			return nil, errors.New("invalid ogg page header")
+		}
+		segmentCount := int(data[26])
+		if len(data) < oggPageHeaderSize+segmentCount {
+			return nil, errors.New("truncated ogg segment table")
+		}
+		segments := data[oggPageHeaderSize : oggPageHeaderSize+segmentCount]
+		bodySize := 0
+		for _, size := range segments {
+			bodySize += int(size)
+		}
+		start := oggPageHeaderSize + segmentCount
+		if len(data) < start+bodySize {
+			return nil, errors.New("truncated ogg page")
+		}
+		pages = append(pages, oggPage{
+			headerType: data[5],
+			granule:    int64(binary.LittleEndian.Uint64(data[6:14])),
+			serial:     binary.LittleEndian.Uint32(data[14:18]),
+			segments:   segments,
+			body:       data[start : start+bodySize],
+		})
+		data = data[start+bodySize:]
+	}
+	return pages, nil
+}
+
+type oggStream struct {
+	packets     [][]byte
+	current     []byte
+	lastGranule int64
+}
+
+// addPage joins the segments of the page to the packets of the stream and
+// updates the last granule position.
+func (stream *oggStream) addPage(page oggPage) {
+	offset := 0
+	for _, size := range page.segments {
+		stream.current = append(stream.current, page.body[offset:offset+int(size)]...)
+		offset += int(size)
+		// A segment shorter than 255 bytes ends the packet.
+		if size < 255 {
+			stream.packets = append(stream.packets, stream.current)
+			stream.current = nil
+		}
+	}
+	if page.granule != -1 {
+		stream.lastGranule = page.granule
+	}
+}
+
+// readOggStreams sorts the pages into their logical streams in a single pass.
+// The streams are returned in the order in which they start.
+func readOggStreams(pages []oggPage) ([]*oggStream, error) {
+	streamsBySerial := make(map[uint32]*oggStream)
+	var streams []*oggStream
+	for _, page := range pages {
+		stream, found := streamsBySerial[page.serial]
+		isBOS := page.headerType&oggHeaderTypeBOS != 0
+		if !found {
+			// Every stream starts with a beginning of stream page, so pages of
+			// streams that haven't started are ignored.
+			if !isBOS {
+				continue
+			} else if len(streams) >= maxOggStreams {
+				return nil, errors.New("ogg file has too many streams")
+			}
+			stream = &oggStream{lastGranule: -1}
+			streamsBySerial[page.serial] = stream
+			streams = append(streams, stream)
+		} else if isBOS {
+			// A stream only starts once.
+			continue
+		}
+		stream.addPage(page)
+	}
+	return streams, nil
+}
+
+// ParseOgg reads the metadata of the Opus, Vorbis and Theora streams in the
+// Ogg file. The duration of a stream is the granule position of its last page.
+// If there is both audio and video, the duration of the first audio stream is
+// used.
+func ParseOgg(data []byte) (*Info, error) {
+	pages, err := readOggPages(data)
+	if err != nil {
+		return nil, err
+	} else if len(pages) == 0 {
+		return nil, errors.New("ogg file doesn't have any pages")
+	}
+
+	streams, err := readOggStreams(pages)
+	if err != nil {
+		return nil, err
+	}
+
+	var audio, video *Info
+	for _, stream := range streams {
+		if len(stream.packets) == 0 {
+			continue
+		}
+		packets, lastGranule := stream.packets, stream.lastGranule
+		header := packets[0]
+		switch {
+		case bytes.HasPrefix(header, []byte("OpusHead")) && audio == nil:
+			if len(header) < 19 {
+				return nil, errors.New("opus header is too short")
+			}
+			audio = &Info{MimeType: "audio/ogg", Codec: "opus"}
+			preSkip := int64(binary.LittleEndian.Uint16(header[10:12]))
+			audio.Duration = oggGranuleDuration(lastGranule-preSkip, opusSampleRate, 1)
+			// The first two packets are the identification and comment headers.
+			if len(packets) > 2 {
+				audio.Waveform = opusWaveform(packets[2:])
+			}
+		case bytes.HasPrefix(header, []byte("\x01vorbis")) && audio == nil:
+			if len(header) < 16 {
+				return nil, errors.New("vorbis header is too short")
+			}
+			audio = &Info{MimeType: "audio/ogg", Codec: "vorbis"}
+			sampleRate := int64(binary.LittleEndian.Uint32(header[12:16]))
+			audio.Duration = oggGranuleDuration(lastGranule, sampleRate, 1)
+		case bytes.HasPrefix(header, []byte("\x80theora")) && video == nil:
+			if len(header) < 42 {
+				return nil, errors.New("theora header is too short")
+			}
+			video = &Info{
+				MimeType: "video/ogg",
+				Codec:    "theora",
+				Width:    int(uint32(header[14])<<16 | uint32(header[15])<<8 | uint32(header[16])),
+				Height:   int(uint32(header[17])<<16 | uint32(header[18])<<8 | uint32(header[19])),
+			}
+			frameRateNumerator := int64(binary.BigEndian.Uint32(header[22:26]))
+			frameRateDenominator := int64(binary.BigEndian.Uint32(header[26:30]))
+			// The granule position is split into the last keyframe and the
+			// number of frames since it.
+			keyframeShift := (binary.BigEndian.Uint16(header[40:42]) >> 5) & 0x1f
+			if lastGranule > 0 {
+				frames := lastGranule>>keyframeShift + lastGranule&(1<<keyframeShift-1)
+				video.Duration = oggGranuleDuration(frames, frameRateNumerator, frameRateDenominator)
+			}
+		}
+	}
+
+	switch {
+	case video != nil:
+		if audio != nil {
+			video.Duration = audio.Duration
+		}
+		return video, nil
+	case audio != nil:
+		return audio, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown ogg codec", ErrUnsupportedFormat)
+	}
+}
+
+// oggGranuleDuration converts a number of samples or frames to a duration.
+// The rate is given as a fraction. The granule position can be anything in
+// crafted files, so durations that don't fit in a time.Duration are unknown.
+func oggGranuleDuration(granule, rateNumerator, rateDenominator int64) time.Duration {
+	if granule <= 0 || rateNumerator <= 0 || rateDenominator <= 0 {
+		return 0
+	}
+	duration := new(big.Int).Mul(big.NewInt(granule), big.NewInt(rateDenominator))
+	duration.Mul(duration, big.NewInt(int64(time.Second)))
+	duration.Quo(duration, big.NewInt(rateNumerator))
+	if !duration.IsInt64() || duration.Sign() <= 0 {
+		return 0
+	}
+	return time.Duration(duration.Int64())
+}
+
+// opusWaveform estimates the waveform of the audio from the sizes of the Opus
+// packets. Decoding the audio would need a full Opus decoder, but with
+// variable bitrate encoding (which voice recorders use) louder audio takes
+// more bytes, so the packet sizes follow the loudness closely enough for a
+// voice message preview.
+func opusWaveform(packets [][]byte) []int {
+	if len(packets) == 0 {
+		return nil
+	}
+	length := waveformLength
+	if len(packets) < length {
+		length = len(packets)
+	}
+	sums := make([]int, length)
+	counts := make([]int, length)
+	for i, packet := range packets {
+		bucket := i * length / len(packets)
+		sums[bucket] += len(packet)
+		counts[bucket]++
+	}
+
+	averages := make([]int, length)
+	maxAverage := 0
+	for i := range sums {
+		if counts[i] > 0 {
+			averages[i] = sums[i] / counts[i]
+		}
+		if averages[i] > maxAverage {
+			maxAverage = averages[i]
+		}
+	}
+	waveform := make([]int, length)
+	if maxAverage == 0 {
+		return waveform
+	}
+	for i, average := range averages {
+		waveform[i] = average * waveformMax / maxAverage
+	}
+	return waveform
+}
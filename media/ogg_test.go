@@ -0,0 +1,218 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+)
+
+// buildOggPage builds an Ogg page with the packets, which must each be
+// shorter than 255 bytes. The checksum is left empty since it isn't checked.
+func buildOggPage(headerType byte, granule int64, serial uint32, packets ...[]byte) []byte {
+	page := make([]byte, oggPageHeaderSize)
+	copy(page, oggCapturePattern)
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:14], uint64(granule))
+	binary.LittleEndian.PutUint32(page[14:18], serial)
+	page[26] = byte(len(packets))
+	for _, packet := range packets {
+		page = append(page, byte(len(packet)))
+	}
+	for _, packet := range packets {
+		page = append(page, packet...)
+	}
+	return page
+}
+
+func opusHeader(preSkip uint16) []byte {
+	header := append([]byte("OpusHead"), 1, 1, 0, 0, 0x80, 0xbb, 0, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint16(header[10:12], preSkip)
+	return header
+}
+
+func vorbisHeader(sampleRate uint32) []byte {
+	header := append([]byte("\x01vorbis"), make([]byte, 23)...)
+	binary.LittleEndian.PutUint32(header[12:16], sampleRate)
+	return header
+}
+
+func theoraHeader(width, height int, frameRate uint32, keyframeShift uint16) []byte {
+	header := append([]byte("\x80theora"), make([]byte, 35)...)
+	header[14], header[15], header[16] = byte(width>>16), byte(width>>8), byte(width)
+	header[17], header[18], header[19] = byte(height>>16), byte(height>>8), byte(height)
+	binary.BigEndian.PutUint32(header[22:26], frameRate)
+	binary.BigEndian.PutUint32(header[26:30], 1)
+	binary.BigEndian.PutUint16(header[40:42], keyframeShift<<5)
+	return header
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestParseOgg(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected Info
+	}{
+		{
+			name: "opus",
+			data: concat(
+				buildOggPage(oggHeaderTypeBOS, 0, 1, opusHeader(312)),
+				buildOggPage(0, 0, 1, []byte("OpusTags")),
+				buildOggPage(0, 48000+312, 1, make([]byte, 10), make([]byte, 40)),
+				buildOggPage(0, 3*48000+312, 1, make([]byte, 20)),
+			),
+			expected: Info{MimeType: "audio/ogg", Codec: "opus", Duration: 3 * time.Second, Waveform: []int{256, 1024, 512}},
+		},
+		{
+			name: "vorbis",
+			data: concat(
+				buildOggPage(oggHeaderTypeBOS, 0, 7, vorbisHeader(44100)),
+				buildOggPage(0, 44100/2, 7, []byte{1}),
+			),
+			expected: Info{MimeType: "audio/ogg", Codec: "vorbis", Duration: 500 * time.Millisecond},
+		},
+		{
+			name: "theora",
+			data: concat(
+				buildOggPage(oggHeaderTypeBOS, 0, 1, theoraHeader(640, 360, 25, 6)),
+				// The keyframe 40 and 10 frames since it
+				buildOggPage(0, 40<<6|10, 1, []byte{1}),
+			),
+			expected: Info{MimeType: "video/ogg", Codec: "theora", Duration: 2 * time.Second, Width: 640, Height: 360},
+		},
+		{
+			name: "theora with audio duration",
+			data: concat(
+				buildOggPage(oggHeaderTypeBOS, 0, 1, theoraHeader(320, 240, 25, 6)),
+				buildOggPage(oggHeaderTypeBOS, 0, 2, vorbisHeader(8000)),
+				buildOggPage(0, 1<<6, 1, []byte{1}),
+				buildOggPage(0, 12000, 2, []byte{1}),
+			),
+			expected: Info{MimeType: "video/ogg", Codec: "theora", Duration: 1500 * time.Millisecond, Width: 320, Height: 240},
+		},
+		{
+			// The granule times a second doesn't fit in 64 bits, but the
+			// duration does.
+			name: "vorbis with large granule",
+			data: concat(
+				buildOggPage(oggHeaderTypeBOS, 0, 3, vorbisHeader(48000)),
+				buildOggPage(0, 1<<40, 3, []byte{1}),
+			),
+			expected: Info{MimeType: "audio/ogg", Codec: "vorbis", Duration: 22906492245333333},
+		},
+		{
+			name: "vorbis with granule beyond the maximum duration",
+			data: concat(
+				buildOggPage(oggHeaderTypeBOS, 0, 3, vorbisHeader(1)),
+				buildOggPage(0, 1<<62, 3, []byte{1}),
+			),
+			expected: Info{MimeType: "audio/ogg", Codec: "vorbis"},
+		},
+		{
+			name: "opus with negative granule",
+			data: concat(
+				buildOggPage(oggHeaderTypeBOS, 0, 1, opusHeader(312)),
+				buildOggPage(0, 0, 1, []byte("OpusTags")),
+				buildOggPage(0, -1, 1, make([]byte, 10)),
+			),
+			expected: Info{MimeType: "audio/ogg", Codec: "opus", Waveform: []int{1024}},
+		},
+		{
+			name: "pages before the stream starts are ignored",
+			data: concat(
+				buildOggPage(0, 1000000, 5, []byte{1}),
+				buildOggPage(oggHeaderTypeBOS, 0, 5, vorbisHeader(1000)),
+				buildOggPage(0, 1000, 5, []byte{1}),
+			),
+			expected: Info{MimeType: "audio/ogg", Codec: "vorbis", Duration: time.Second},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			info, err := Parse(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertInfo(t, info, test.expected)
+		})
+	}
+}
+
+func TestParseOggErrors(t *testing.T) {
+	opus := concat(
+		buildOggPage(oggHeaderTypeBOS, 0, 1, opusHeader(0)),
+		buildOggPage(0, 48000, 1, make([]byte, 100)),
+	)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"truncated page header", opus[:20]},
+		{"truncated segment table", opus[:oggPageHeaderSize]},
+		{"truncated page", opus[:len(opus)-1]},
+		{"unknown codec", buildOggPage(oggHeaderTypeBOS, 0, 1, []byte("Speex   "))},
+		{"short opus header", buildOggPage(oggHeaderTypeBOS, 0, 1, []byte("OpusHead"))},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if info, err := Parse(test.data); err == nil {
+				t.Errorf("expected an error, got %+v", info)
+			}
+		})
+	}
+
+	_, err := Parse(buildOggPage(oggHeaderTypeBOS, 0, 1, []byte("Speex   ")))
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("expected ErrUnsupportedFormat for an unknown codec, got %v", err)
+	}
+}
+
+// TestParseOggManyPages checks that files made of many tiny beginning of
+// stream pages are parsed in linear time.
+func TestParseOggManyPages(t *testing.T) {
+	emptyBOSPage := func(serial uint32) []byte {
+		return buildOggPage(oggHeaderTypeBOS, 0, serial, []byte{})
+	}
+	const size = 1 << 20
+
+	t.Run("same serial", func(t *testing.T) {
+		data := buildOggPage(oggHeaderTypeBOS, 0, 1, vorbisHeader(1000))
+		for len(data) < size {
+			data = append(data, emptyBOSPage(1)...)
+		}
+		data = append(data, buildOggPage(0, 2000, 1, []byte{1})...)
+		info, err := Parse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertInfo(t, info, Info{MimeType: "audio/ogg", Codec: "vorbis", Duration: 2 * time.Second})
+	})
+
+	t.Run("different serials", func(t *testing.T) {
+		var data []byte
+		for serial := uint32(0); len(data) < size; serial++ {
+			data = append(data, emptyBOSPage(serial)...)
+		}
+		if _, err := Parse(data); err == nil {
+			t.Error("expected an error for too many streams")
+		}
+	})
+
+	t.Run("too many pages", func(t *testing.T) {
+		data := buildOggPage(oggHeaderTypeBOS, 0, 1, vorbisHeader(1000))
+		page := buildOggPage(0, 0, 1, []byte{})
+		for i := 0; i < maxOggPages; i++ {
+			data = append(data, page...)
+		}
+		if _, err := Parse(data); err == nil {
+			t.Error("expected an error for too many pages")
+		}
+	})
+}
@@ -0,0 +1,39 @@
+package media
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// ParseWAV reads the duration of a RIFF WAVE file from the byte rate in the
+// fmt chunk and the size of the data chunk.
+func ParseWAV(data []byte) (*Info, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, ErrUnsupportedFormat
+	}
+	info := &Info{MimeType: "audio/wav", Codec: "pcm"}
+
+	var byteRate uint32
+	for offset := 12; offset+8 <= len(data); {
+		chunkID := string(data[offset : offset+4])
+		chunkSize := binary.LittleEndian.Uint32(data[offset+4 : offset+8])
+		body := data[offset+8:]
+		switch chunkID {
+		case "fmt ":
+			if len(body) < 12 {
+				return nil, errors.New("wav fmt chunk is too short")
+			}
+			byteRate = binary.LittleEndian.Uint32(body[8:12])
+		case "data":
+			if byteRate == 0 {
+				return nil, errors.New("wav data chunk before fmt chunk")
+			}
+			info.Duration = time.Duration(uint64(chunkSize) * uint64(time.Second) / uint64(byteRate))
+			return info, nil
+		}
+		// Chunks are padded to an even size.
+		offset += 8 + int(chunkSize) + int(chunkSize&1)
+	}
+	return nil, errors.New("wav file doesn't have a data chunk")
+}
@@ -0,0 +1,78 @@
+package media
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+func buildWAVChunk(id string, body []byte) []byte {
+	chunk := make([]byte, 8, 8+len(body)+1)
+	copy(chunk, id)
+	binary.LittleEndian.PutUint32(chunk[4:8], uint32(len(body)))
+	chunk = append(chunk, body...)
+	if len(body)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func buildWAV(byteRate uint32, chunks ...[]byte) []byte {
+	fmtBody := make([]byte, 16)
+	binary.LittleEndian.PutUint16(fmtBody[0:2], 1)
+	binary.LittleEndian.PutUint32(fmtBody[8:12], byteRate)
+	body := append([]byte("WAVE"), buildWAVChunk("fmt ", fmtBody)...)
+	for _, chunk := range chunks {
+		body = append(body, chunk...)
+	}
+	header := make([]byte, 8)
+	copy(header, "RIFF")
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(body)))
+	return append(header, body...)
+}
+
+func TestParseWAV(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		duration time.Duration
+	}{
+		{"data chunk", buildWAV(16000, buildWAVChunk("data", make([]byte, 40000))), 2500 * time.Millisecond},
+		{"odd sized chunk before data", buildWAV(1000, buildWAVChunk("LIST", make([]byte, 3)), buildWAVChunk("data", make([]byte, 500))), 500 * time.Millisecond},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			info, err := Parse(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertInfo(t, info, Info{MimeType: "audio/wav", Codec: "pcm", Duration: test.duration})
+		})
+	}
+}
+
+func TestParseWAVErrors(t *testing.T) {
+	fmtBody := make([]byte, 16)
+	binary.LittleEndian.PutUint32(fmtBody[8:12], 1000)
+	dataFirst := append([]byte("RIFF\x00\x00\x00\x00WAVE"), buildWAVChunk("data", make([]byte, 4))...)
+	dataFirst = append(dataFirst, buildWAVChunk("fmt ", fmtBody)...)
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no data chunk", buildWAV(1000)},
+		{"data chunk before fmt chunk", dataFirst},
+		{"short fmt chunk", append([]byte("RIFF\x00\x00\x00\x00WAVE"), buildWAVChunk("fmt ", make([]byte, 4))...)},
+		{"truncated chunk header", buildWAV(1000)[:14]},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if info, err := Parse(test.data); err == nil {
+				t.Errorf("expected an error, got %+v", info)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package media
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"strings"
+	"time"
+)
+
+var ebmlMagic = []byte{0x1a, 0x45, 0xdf, 0xa3}
+
+// Matroska element IDs, including the length marker bits.
+const (
+	ebmlIDHeader         = 0x1a45dfa3
+	ebmlIDDocType        = 0x4282
+	ebmlIDSegment        = 0x18538067
+	ebmlIDInfo           = 0x1549a966
+	ebmlIDTimecodeScale  = 0x2ad7b1
+	ebmlIDDuration       = 0x4489
+	ebmlIDTracks         = 0x1654ae6b
+	ebmlIDTrackEntry     = 0xae
+	ebmlIDTrackType      = 0x83
+	ebmlIDCodecID        = 0x86
+	ebmlIDVideo          = 0xe0
+	ebmlIDPixelWidth     = 0xb0
+	ebmlIDPixelHeight    = 0xba
+	ebmlIDAttachments    = 0x1941a469
+	ebmlIDAttachedFile   = 0x61a7
+	ebmlIDFileMimeType   = 0x4660
+	ebmlIDFileData       = 0x465c
+	matroskaTrackVideo   = 1
+	matroskaTrackAudio   = 2
+	defaultTimecodeScale = 1000000
+)
+
+type ebmlElement struct {
+	id   uint64
+	body []byte
+}
+
+// readEBMLVint reads a variable length integer. If keepMarker is set, the
+// length marker bit is kept, which is how element IDs are written.
+func readEBMLVint(data []byte, keepMarker bool) (value uint64, length int, err error) {
+	if len(data) == 0 || data[0] == 0 {
+		return 0, 0, errors.New("invalid ebml variable length integer")
+	}
+	length = 1
+	for mask := byte(0x80); data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if len(data) < length {
+		return 0, 0, errors.New("truncated ebml variable length integer")
+	}
+	value = uint64(data[0])
+	if !keepMarker {
+		value &= 0xff >> length
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length, nil
+}
+
+// readEBMLElements splits the data into EBML elements. Elements with an
+// unknown size (which streaming muxers write for segments and clusters)
+// extend to the end of the data. On errors, the elements before the invalid
+// one are returned with the error.
+func readEBMLElements(data []byte) ([]ebmlElement, error) {
+	var elements []ebmlElement
+	for len(data) > 0 {
+		elementID, idLength, err := readEBMLVint(data, true)
+		if err != nil {
+			return elements, err
+		}
+		size, sizeLength, err := readEBMLVint(data[idLength:], false)
+		if err != nil {
+			return elements, err
+		}
+		start := idLength + sizeLength
+		if size == 1<<(7*sizeLength)-1 {
+			size = uint64(len(data) - start)
+		} else if size > uint64(len(data)-start) {
+			return elements, errors.New("invalid ebml element size")
+		}
+		elements = append(elements, ebmlElement{id: elementID, body: data[start : start+int(size)]})
+		data = data[start+int(size):]
+	}
+	return elements, nil
+}
+
+func ebmlUint(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+func ebmlFloat(data []byte) float64 {
+	switch len(data) {
+	case 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(data)))
+	case 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(data))
+	default:
+		return 0
+	}
+}
+
+// ParseWebM reads the duration, the dimensions of the first video track and
+// the codecs from a WebM (or Matroska) file. An image attachment, which is
+// how Matroska files store cover art, is used as the thumbnail.
+func ParseWebM(data []byte) (*Info, error) {
+	if !bytes.HasPrefix(data, ebmlMagic) {
+		return nil, ErrUnsupportedFormat
+	}
+	elements, err := readEBMLElements(data)
+	if err != nil && len(elements) == 0 {
+		return nil, err
+	}
+
+	mimeSubtype := "webm"
+	var segment []byte
+	for _, element := range elements {
+		switch element.id {
+		case ebmlIDHeader:
+			headerElements, err := readEBMLElements(element.body)
+			if err != nil {
+				return nil, err
+			}
+			for _, headerElement := range headerElements {
+				if headerElement.id == ebmlIDDocType && string(headerElement.body) == "matroska" {
+					mimeSubtype = "x-matroska"
+				}
+			}
+		case ebmlIDSegment:
+			segment = element.body
+		}
+	}
+	if segment == nil {
+		return nil, errors.New("webm file doesn't have a segment")
+	}
+
+	// Broken elements after the metadata, such as cut off clusters, don't
+	// matter, so the error is ignored.
+	segmentElements, _ := readEBMLElements(segment)
+	info := &Info{MimeType: "audio/" + mimeSubtype}
+	for _, element := range segmentElements {
+		switch element.id {
+		case ebmlIDInfo:
+			info.Duration = matroskaDuration(element.body)
+		case ebmlIDTracks:
+			parseMatroskaTracks(element.body, info, mimeSubtype)
+		case ebmlIDAttachments:
+			info.Thumbnail = matroskaCoverArt(element.body)
+		}
+	}
+	return info, nil
+}
+
+// matroskaDuration reads the duration from the segment info. The duration is
+// a float in units of the timecode scale, which is in nanoseconds.
+func matroskaDuration(segmentInfo []byte) time.Duration {
+	elements, err := readEBMLElements(segmentInfo)
+	if err != nil {
+		return 0
+	}
+	timecodeScale := uint64(defaultTimecodeScale)
+	var duration float64
+	for _, element := range elements {
+		switch element.id {
+		case ebmlIDTimecodeScale:
+			timecodeScale = ebmlUint(element.body)
+		case ebmlIDDuration:
+			duration = ebmlFloat(element.body)
+		}
+	}
+	return time.Duration(duration * float64(timecodeScale))
+}
+
+func parseMatroskaTracks(tracks []byte, info *Info, mimeSubtype string) {
+	entries, err := readEBMLElements(tracks)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.id != ebmlIDTrackEntry {
+			continue
+		}
+		elements, err := readEBMLElements(entry.body)
+		if err != nil {
+			continue
+		}
+		var trackType uint64
+		var codec string
+		var width, height int
+		for _, element := range elements {
+			switch element.id {
+			case ebmlIDTrackType:
+				trackType = ebmlUint(element.body)
+			case ebmlIDCodecID:
+				codec = strings.TrimRight(string(element.body), "\x00")
+			case ebmlIDVideo:
+				videoElements, err := readEBMLElements(element.body)
+				if err != nil {
+					continue
+				}
+				for _, videoElement := range videoElements {
+					switch videoElement.id {
+					case ebmlIDPixelWidth:
+						width = int(ebmlUint(videoElement.body))
+					case ebmlIDPixelHeight:
+						height = int(ebmlUint(videoElement.body))
+					}
+				}
+			}
+		}
+
+		if trackType == matroskaTrackVideo && info.Width == 0 {
+			info.MimeType = "video/" + mimeSubtype
+			info.Codec = codec
+			info.Width = width
+			info.Height = height
+		} else if trackType == matroskaTrackAudio && info.Codec == "" {
+			info.Codec = codec
+		}
+	}
+}
+
+// matroskaCoverArt returns the first JPEG or PNG attachment, if any.
+func matroskaCoverArt(attachments []byte) []byte {
+	files, err := readEBMLElements(attachments)
+	if err != nil {
+		return nil
+	}
+	for _, file := range files {
+		if file.id != ebmlIDAttachedFile {
+			continue
+		}
+		elements, err := readEBMLElements(file.body)
+		if err != nil {
+			continue
+		}
+		var mimeType string
+		var fileData []byte
+		for _, element := range elements {
+			switch element.id {
+			case ebmlIDFileMimeType:
+				mimeType = string(element.body)
+			case ebmlIDFileData:
+				fileData = element.body
+			}
+		}
+		if mimeType == "image/jpeg" || mimeType == "image/png" {
+			return fileData
+		}
+	}
+	return nil
+}
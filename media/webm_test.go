@@ -0,0 +1,173 @@
+package media
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+	"time"
+)
+
+// buildEBMLElement builds an element with the ID (including the length marker
+// bits) and the children as its body.
+func buildEBMLElement(elementID uint64, children ...[]byte) []byte {
+	var element []byte
+	for shift := 24; shift >= 0; shift -= 8 {
+		if b := byte(elementID >> shift); b != 0 || len(element) > 0 {
+			element = append(element, b)
+		}
+	}
+	body := concat(children...)
+	if len(body) < 0x7f {
+		element = append(element, 0x80|byte(len(body)))
+	} else {
+		size := make([]byte, 8)
+		binary.BigEndian.PutUint64(size, uint64(len(body)))
+		size[0] = 0x01
+		element = append(element, size...)
+	}
+	return append(element, body...)
+}
+
+// buildUnknownSizeEBMLElement builds an element with the reserved unknown
+// size, which extends to the end of the data.
+func buildUnknownSizeEBMLElement(elementID uint64, children ...[]byte) []byte {
+	element := buildEBMLElement(elementID)
+	element[len(element)-1] = 0xff
+	return append(element, concat(children...)...)
+}
+
+func ebmlFloat64(value float64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, math.Float64bits(value))
+	return data
+}
+
+func ebmlFloat32(value float32) []byte {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint32(data, math.Float32bits(value))
+	return data
+}
+
+func ebmlHeader(docType string) []byte {
+	return buildEBMLElement(ebmlIDHeader, buildEBMLElement(ebmlIDDocType, []byte(docType)))
+}
+
+func matroskaInfo(timecodeScale []byte, duration []byte) []byte {
+	var children [][]byte
+	if timecodeScale != nil {
+		children = append(children, buildEBMLElement(ebmlIDTimecodeScale, timecodeScale))
+	}
+	return buildEBMLElement(ebmlIDInfo, append(children, buildEBMLElement(ebmlIDDuration, duration))...)
+}
+
+func matroskaVideoTrack(codec string, width, height uint16) []byte {
+	dimensions := make([]byte, 4)
+	binary.BigEndian.PutUint16(dimensions[0:2], width)
+	binary.BigEndian.PutUint16(dimensions[2:4], height)
+	return buildEBMLElement(ebmlIDTrackEntry,
+		buildEBMLElement(ebmlIDTrackType, []byte{matroskaTrackVideo}),
+		buildEBMLElement(ebmlIDCodecID, []byte(codec)),
+		buildEBMLElement(ebmlIDVideo,
+			buildEBMLElement(ebmlIDPixelWidth, dimensions[0:2]),
+			buildEBMLElement(ebmlIDPixelHeight, dimensions[2:4]),
+		),
+	)
+}
+
+func matroskaAudioTrack(codec string) []byte {
+	return buildEBMLElement(ebmlIDTrackEntry,
+		buildEBMLElement(ebmlIDTrackType, []byte{matroskaTrackAudio}),
+		buildEBMLElement(ebmlIDCodecID, []byte(codec)),
+	)
+}
+
+func matroskaAttachment(mimeType string, data []byte) []byte {
+	return buildEBMLElement(ebmlIDAttachedFile,
+		buildEBMLElement(ebmlIDFileMimeType, []byte(mimeType)),
+		buildEBMLElement(ebmlIDFileData, data),
+	)
+}
+
+const ebmlIDCluster = 0x1f43b675
+
+func buildTestWebM() []byte {
+	return concat(
+		ebmlHeader("webm"),
+		buildUnknownSizeEBMLElement(ebmlIDSegment,
+			matroskaInfo([]byte{0x0f, 0x42, 0x40}, ebmlFloat64(4200)),
+			buildEBMLElement(ebmlIDTracks, matroskaAudioTrack("A_OPUS"), matroskaVideoTrack("V_VP9", 640, 480)),
+			buildUnknownSizeEBMLElement(ebmlIDCluster, []byte{1, 2, 3}),
+		),
+	)
+}
+
+func TestParseWebM(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		expected Info
+	}{
+		{
+			name:     "video with unknown sizes",
+			data:     buildTestWebM(),
+			expected: Info{MimeType: "video/webm", Codec: "V_VP9", Duration: 4200 * time.Millisecond, Width: 640, Height: 480},
+		},
+		{
+			name: "audio only with default timecode scale",
+			data: concat(ebmlHeader("webm"), buildEBMLElement(ebmlIDSegment,
+				matroskaInfo(nil, ebmlFloat32(1500)),
+				buildEBMLElement(ebmlIDTracks, matroskaAudioTrack("A_VORBIS")),
+			)),
+			expected: Info{MimeType: "audio/webm", Codec: "A_VORBIS", Duration: 1500 * time.Millisecond},
+		},
+		{
+			name: "matroska with cover art",
+			data: concat(ebmlHeader("matroska"), buildEBMLElement(ebmlIDSegment,
+				matroskaInfo([]byte{0x0f, 0x42, 0x40}, ebmlFloat64(1000)),
+				buildEBMLElement(ebmlIDTracks, matroskaVideoTrack("V_MPEG4/ISO/AVC", 1920, 1080)),
+				buildEBMLElement(ebmlIDAttachments,
+					matroskaAttachment("application/x-truetype-font", []byte("font")),
+					matroskaAttachment("image/jpeg", testJPEG),
+				),
+			)),
+			expected: Info{MimeType: "video/x-matroska", Codec: "V_MPEG4/ISO/AVC", Duration: time.Second, Width: 1920, Height: 1080, Thumbnail: testJPEG},
+		},
+		{
+			name: "cut off cluster",
+			data: concat(ebmlHeader("webm"), buildUnknownSizeEBMLElement(ebmlIDSegment,
+				buildEBMLElement(ebmlIDTracks, matroskaVideoTrack("V_VP8", 320, 240)),
+				buildEBMLElement(ebmlIDCluster, make([]byte, 200))[:50],
+			)),
+			expected: Info{MimeType: "video/webm", Codec: "V_VP8", Width: 320, Height: 240},
+		},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			info, err := Parse(test.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertInfo(t, info, test.expected)
+		})
+	}
+}
+
+func TestParseWebMErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"no segment", ebmlHeader("webm")},
+		{"truncated header", ebmlHeader("webm")[:6]},
+		{"invalid variable length integer", concat(ebmlHeader("webm"), []byte{0x18, 0x53, 0x80, 0x67, 0x00})},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			if info, err := Parse(test.data); err == nil {
+				t.Errorf("expected an error, got %+v", info)
+			}
+		})
+	}
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"maunium.net/go/mautrix"
+	"maunium.net/go/mautrix/event"
+	"maunium.net/go/mautrix/id"
+
+	"github.com/beeper/chatwoot/chatwootapi"
+	"github.com/beeper/chatwoot/database"
+)
+
+// Polls are sent with the unstable MSC3381 event types since that is what most
+// clients support, but both the unstable and stable types are bridged.
+var (
+	pollStartType          = event.Type{Type: "org.matrix.msc3381.poll.start", Class: event.MessageEventType}
+	pollResponseType       = event.Type{Type: "org.matrix.msc3381.poll.response", Class: event.MessageEventType}
+	pollEndType            = event.Type{Type: "org.matrix.msc3381.poll.end", Class: event.MessageEventType}
+	stablePollStartType    = event.Type{Type: "m.poll.start", Class: event.MessageEventType}
+	stablePollResponseType = event.Type{Type: "m.poll.response", Class: event.MessageEventType}
+	stablePollEndType      = event.Type{Type: "m.poll.end", Class: event.MessageEventType}
+)
+
+var pollEventTypes = []event.Type{
+	pollStartType,
+	pollResponseType,
+	pollEndType,
+	stablePollStartType,
+	stablePollResponseType,
+	stablePollEndType,
+}
+
+const extensibleTextKey = "org.matrix.msc1767.text"
+
+type unstablePollText struct {
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type unstablePollAnswer struct {
+	ID   string `json:"id"`
+	Text string `json:"org.matrix.msc1767.text"`
+}
+
+type unstablePollStart struct {
+	Question      unstablePollText     `json:"question"`
+	Kind          string               `json:"kind,omitempty"`
+	MaxSelections int                  `json:"max_selections"`
+	Answers       []unstablePollAnswer `json:"answers"`
+}
+
+type stablePollText []struct {
+	Body     string `json:"body"`
+	MimeType string `json:"mimetype,omitempty"`
+}
+
+// String returns the plain text representation of the text.
+func (t stablePollText) String() string {
+	for _, representation := range t {
+		if representation.MimeType == "" || representation.MimeType == "text/plain" {
+			return representation.Body
+		}
+	}
+	if len(t) > 0 {
+		return t[0].Body
+	}
+	return ""
+}
+
+type stablePollAnswer struct {
+	ID   string         `json:"m.id"`
+	Text stablePollText `json:"m.text"`
+}
+
+type stablePollStart struct {
+	Question struct {
+		Text stablePollText `json:"m.text"`
+	} `json:"question"`
+	MaxSelections int                `json:"max_selections"`
+	Answers       []stablePollAnswer `json:"answers"`
+}
+
+type pollStartContent struct {
+	Unstable *unstablePollStart `json:"org.matrix.msc3381.poll.start"`
+	Stable   *stablePollStart   `json:"m.poll"`
+}
+
+type pollResponseContent struct {
+	RelatesTo *event.RelatesTo `json:"m.relates_to"`
+	Unstable  *struct {
+		Answers []string `json:"answers"`
+	} `json:"org.matrix.msc3381.poll.response"`
+	Selections []string `json:"m.selections"`
+}
+
+type pollEndContent struct {
+	RelatesTo *event.RelatesTo `json:"m.relates_to"`
+}
+
+// unmarshalEventContent parses the content of an event type that mautrix
+// doesn't know about.
+func unmarshalEventContent(evt *event.Event, into any) error {
+	data := []byte(evt.Content.VeryRaw)
+	if len(data) == 0 {
+		var err error
+		if data, err = json.Marshal(evt.Content.Raw); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(data, into)
+}
+
+// parsePollStart returns the poll from either an unstable or a stable poll
+// start event.
+func parsePollStart(evt *event.Event) (*database.MatrixPoll, error) {
+	var content pollStartContent
+	if err := unmarshalEventContent(evt, &content); err != nil {
+		return nil, err
+	}
+	poll := &database.MatrixPoll{
+		EventID: evt.ID,
+		RoomID:  evt.RoomID,
+		Sender:  evt.Sender,
+	}
+	if content.Unstable != nil {
+		poll.Question = content.Unstable.Question.Text
+		poll.MaxSelections = content.Unstable.MaxSelections
+		for _, answer := range content.Unstable.Answers {
+			poll.Answers = append(poll.Answers, database.PollAnswer{ID: answer.ID, Text: answer.Text})
+		}
+	} else if content.Stable != nil {
+		poll.Question = content.Stable.Question.Text.String()
+		poll.MaxSelections = content.Stable.MaxSelections
+		for _, answer := range content.Stable.Answers {
+			poll.Answers = append(poll.Answers, database.PollAnswer{ID: answer.ID, Text: answer.Text.String()})
+		}
+	} else {
+		return nil, fmt.Errorf("poll start %s doesn't have a poll", evt.ID)
+	}
+	if len(poll.Answers) == 0 {
+		return nil, fmt.Errorf("poll %s doesn't have any answers", evt.ID)
+	}
+	if poll.MaxSelections < 1 {
+		poll.MaxSelections = 1
+	}
+	return poll, nil
+}
+
+// getPollForEvent returns the bridged poll that the response or end event
+// refers to.
+func getPollForEvent(ctx context.Context, evt *event.Event, relatesTo *event.RelatesTo) (*database.MatrixPoll, error) {
+	pollEventID := relatesTo.GetReferenceID()
+	if pollEventID == "" {
+		return nil, fmt.Errorf("%s doesn't refer to a poll", evt.ID)
+	}
+	return stateStore.GetMatrixPoll(ctx, pollEventID)
+}
+
+// sendPollFollowUp sends a message about the poll as a reply to the message
+// that the poll was bridged to.
+func sendPollFollowUp(ctx context.Context, conversationID int, poll *database.MatrixPoll, content string, messageType chatwootapi.MessageType) (*chatwootapi.Message, error) {
+	messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, poll.EventID)
+	if err == nil && len(messageIDs) > 0 {
+		return chatwootAPI.SendReplyMessage(ctx, conversationID, content, messageType, messageIDs[0])
+	}
+	return chatwootAPI.SendTextMessage(ctx, conversationID, content, messageType)
+}
+
+func handleMatrixPollStart(ctx context.Context, evt *event.Event, conversationID int, messageType chatwootapi.MessageType) ([]*chatwootapi.Message, error) {
+	poll, err := parsePollStart(evt)
+	if err != nil {
+		return nil, err
+	}
+	if err = stateStore.AddMatrixPoll(ctx, poll); err != nil {
+		return nil, fmt.Errorf("failed to store poll: %w", err)
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "**Poll:** %s\n", poll.Question)
+	for i, answer := range poll.Answers {
+		fmt.Fprintf(&body, "\n%d. %s", i+1, answer.Text)
+	}
+	if poll.MaxSelections > 1 {
+		fmt.Fprintf(&body, "\n\n*Up to %d answers can be selected.*", poll.MaxSelections)
+	}
+	cm, err := chatwootAPI.SendTextMessage(ctx, conversationID, body.String(), messageType)
+	if err != nil {
+		return nil, err
+	}
+	return []*chatwootapi.Message{cm}, nil
+}
+
+// handleMatrixPollResponse records the vote and sends it to Chatwoot. Votes on
+// polls from Chatwoot are submitted as the selection of the contact on the
+// input_select message if the client API can be used, and are otherwise sent
+// as a reply with the chosen options.
+func handleMatrixPollResponse(ctx context.Context, evt *event.Event, conversationID int, messageType chatwootapi.MessageType) ([]*chatwootapi.Message, error) {
+	log := zerolog.Ctx(ctx)
+
+	var content pollResponseContent
+	if err := unmarshalEventContent(evt, &content); err != nil {
+		return nil, err
+	}
+	poll, err := getPollForEvent(ctx, evt, content.RelatesTo)
+	if err != nil {
+		log.Info().Err(err).Msg("ignoring vote on a poll that wasn't bridged")
+		return nil, nil
+	}
+
+	selections := content.Selections
+	if content.Unstable != nil {
+		selections = content.Unstable.Answers
+	}
+	// Unknown answers are ignored and only the first max_selections answers
+	// count.
+	var answerIDs []string
+	var answerTexts []string
+	var items []chatwootapi.ContentAttributeItem
+	for _, answerID := range selections {
+		if answer, ok := poll.Answer(answerID); ok && len(answerIDs) < poll.MaxSelections {
+			answerIDs = append(answerIDs, answerID)
+			answerTexts = append(answerTexts, answer.Text)
+			items = append(items, chatwootapi.ContentAttributeItem{Title: answer.Text, Value: answer.Value})
+		}
+	}
+	if err = stateStore.SetMatrixPollVote(ctx, poll.EventID, evt.Sender, answerIDs, evt.Timestamp); err != nil {
+		return nil, fmt.Errorf("failed to store poll vote: %w", err)
+	}
+
+	var body string
+	if poll.FromChatwoot {
+		if len(answerTexts) == 0 {
+			return nil, nil
+		}
+		if submitted, err := submitPollSelection(ctx, evt.RoomID, conversationID, poll, items); err != nil {
+			return nil, err
+		} else if submitted {
+			return nil, nil
+		}
+		body = strings.Join(answerTexts, ", ")
+	} else if len(answerTexts) == 0 {
+		body = fmt.Sprintf("*%s removed their vote from the poll.*", matrixUserDisplayName(evt.RoomID, evt.Sender))
+	} else {
+		body = fmt.Sprintf("**Poll vote from %s:** %s", matrixUserDisplayName(evt.RoomID, evt.Sender), strings.Join(answerTexts, ", "))
+	}
+	cm, err := sendPollFollowUp(ctx, conversationID, poll, body, messageType)
+	if err != nil {
+		return nil, err
+	}
+	return []*chatwootapi.Message{cm}, nil
+}
+
+// submitPollSelection submits the items as the selection of the contact on
+// the input_select message that the poll was bridged from. It returns false
+// if the selection can't be submitted because the client API isn't
+// configured or the message is unknown.
+func submitPollSelection(ctx context.Context, roomID id.RoomID, conversationID int, poll *database.MatrixPoll, items []chatwootapi.ContentAttributeItem) (bool, error) {
+	log := zerolog.Ctx(ctx)
+	if chatwootAPI.InboxIdentifier == "" {
+		return false, nil
+	}
+	messageIDs, err := stateStore.GetChatwootMessageIDsForMatrixEventID(ctx, poll.EventID)
+	if err != nil || len(messageIDs) == 0 {
+		log.Warn().Err(err).Msg("no chatwoot message found for poll, sending the vote as a reply")
+		return false, nil
+	}
+	// The conversation was created with the room ID as the source ID of the
+	// contact inbox.
+	err = chatwootAPI.SubmitInputSelect(ctx, roomID.String(), conversationID, messageIDs[0], items)
+	if err != nil {
+		return false, fmt.Errorf("failed to submit poll selection: %w", err)
+	}
+	log.Debug().Int("message_id", messageIDs[0]).Msg("submitted poll selection to chatwoot")
+	return true, nil
+}
+
+// handleMatrixPollEnd sends the results of the poll to Chatwoot. Only the
+// creator of the poll can end it, so end events from anyone else are ignored.
+func handleMatrixPollEnd(ctx context.Context, evt *event.Event, conversationID int, messageType chatwootapi.MessageType) ([]*chatwootapi.Message, error) {
+	log := zerolog.Ctx(ctx)
+
+	var content pollEndContent
+	if err := unmarshalEventContent(evt, &content); err != nil {
+		return nil, err
+	}
+	poll, err := getPollForEvent(ctx, evt, content.RelatesTo)
+	if err != nil {
+		log.Info().Err(err).Msg("ignoring end of a poll that wasn't bridged")
+		return nil, nil
+	}
+	if poll.Sender != evt.Sender {
+		log.Info().
+			Str("poll_creator", poll.Sender.String()).
+			Msg("ignoring end of a poll by a user other than its creator")
+		return nil, nil
+	}
+	votes, err := stateStore.GetMatrixPollVotes(ctx, poll.EventID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get poll votes: %w", err)
+	}
+	counts := map[string]int{}
+	for _, answerIDs := range votes {
+		for _, answerID := range answerIDs {
+			counts[answerID]++
+		}
+	}
+
+	var body strings.Builder
+	fmt.Fprintf(&body, "**Poll ended:** %s\n", poll.Question)
+	for _, answer := range poll.Answers {
+		count := counts[answer.ID]
+		if count == 1 {
+			fmt.Fprintf(&body, "\n- %s: 1 vote", answer.Text)
+		} else {
+			fmt.Fprintf(&body, "\n- %s: %d votes", answer.Text, count)
+		}
+	}
+	cm, err := sendPollFollowUp(ctx, conversationID, poll, body.String(), messageType)
+	if err != nil {
+		return nil, err
+	}
+	return []*chatwootapi.Message{cm}, nil
+}
+
+// sendChatwootPoll sends an input_select message from Chatwoot as a Matrix
+// poll so that the user can choose one of the items.
+func sendChatwootPoll(ctx context.Context, sendAs *mautrix.Client, roomID id.RoomID, question string, items []chatwootapi.ContentAttributeItem, extraContent map[string]any) (*mautrix.RespSendEvent, error) {
+	log := zerolog.Ctx(ctx)
+
+	poll := &database.MatrixPoll{
+		RoomID:        roomID,
+		Sender:        sendAs.UserID,
+		Question:      question,
+		MaxSelections: 1,
+		FromChatwoot:  true,
+	}
+	fallback := question
+	answers := make([]unstablePollAnswer, 0, len(items))
+	for i, item := range items {
+		answerID := strconv.Itoa(i)
+		answers = append(answers, unstablePollAnswer{ID: answerID, Text: item.Title})
+		poll.Answers = append(poll.Answers, database.PollAnswer{ID: answerID, Text: item.Title, Value: item.Value})
+		fallback += fmt.Sprintf("\n%d. %s", i+1, item.Title)
+	}
+
+	content := map[string]any{
+		pollStartType.Type: unstablePollStart{
+			Question:      unstablePollText{Text: question},
+			Kind:          "org.matrix.msc3381.poll.disclosed",
+			MaxSelections: 1,
+			Answers:       answers,
+		},
+		extensibleTextKey: fallback,
+	}
+	for key, value := range extraContent {
+		content[key] = value
+	}
+
+	resp, err := DoRetry(ctx, "send poll to "+roomID.String(), func(context.Context) (*mautrix.RespSendEvent, error) {
+		return sendAs.SendMessageEvent(roomID, pollStartType, &event.Content{Raw: content})
+	})
+	if err != nil {
+		log.Err(err).Msg("failed to send poll")
+		return nil, err
+	}
+	poll.EventID = resp.EventID
+	if err = stateStore.AddMatrixPoll(ctx, poll); err != nil {
+		log.Err(err).Msg("failed to store poll")
+	}
+	return resp, nil
+}
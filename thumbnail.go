@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+)
+
+const thumbnailJPEGQuality = 80
+
+// thumbnailSize returns the size of the thumbnail of an image with the given
+// size, keeping the aspect ratio. It returns false if the image already fits
+// within the maximum dimensions, in which case it doesn't need a thumbnail.
+func thumbnailSize(width, height, maxWidth, maxHeight int) (int, int, bool) {
+	if width <= 0 || height <= 0 || maxWidth <= 0 || maxHeight <= 0 {
+		return 0, 0, false
+	} else if width <= maxWidth && height <= maxHeight {
+		return 0, 0, false
+	}
+	thumbnailWidth, thumbnailHeight := maxWidth, height*maxWidth/width
+	if thumbnailHeight > maxHeight {
+		thumbnailWidth, thumbnailHeight = width*maxHeight/height, maxHeight
+	}
+	if thumbnailWidth < 1 {
+		thumbnailWidth = 1
+	}
+	if thumbnailHeight < 1 {
+		thumbnailHeight = 1
+	}
+	return thumbnailWidth, thumbnailHeight, true
+}
+
+// downscaleImage scales the image down by averaging the source pixels that
+// each thumbnail pixel covers (a box filter), which avoids the aliasing that
+// picking single pixels would cause.
+func downscaleImage(img image.Image, width, height int) *image.RGBA {
+	bounds := img.Bounds()
+	// Working with premultiplied RGBA pixels directly is much faster than
+	// going through At and averages the colors of transparent pixels
+	// correctly.
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	}
+	srcBounds := src.Bounds()
+	srcWidth, srcHeight := srcBounds.Dx(), srcBounds.Dy()
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		startY, endY := y*srcHeight/height, (y+1)*srcHeight/height
+		if endY == startY {
+			endY++
+		}
+		for x := 0; x < width; x++ {
+			startX, endX := x*srcWidth/width, (x+1)*srcWidth/width
+			if endX == startX {
+				endX++
+			}
+			var sums [4]int
+			for sy := startY; sy < endY; sy++ {
+				offset := src.PixOffset(srcBounds.Min.X+startX, srcBounds.Min.Y+sy)
+				for sx := startX; sx < endX; sx++ {
+					for i := range sums {
+						sums[i] += int(src.Pix[offset+i])
+					}
+					offset += 4
+				}
+			}
+			count := (endX - startX) * (endY - startY)
+			dstOffset := dst.PixOffset(x, y)
+			for i, sum := range sums {
+				dst.Pix[dstOffset+i] = uint8(sum / count)
+			}
+		}
+	}
+	return dst
+}
+
+// generateThumbnail downscales the image to fit within the configured
+// maximum thumbnail dimensions. PNG and GIF images can be transparent, so
+// their thumbnails are PNGs and the thumbnails of other images are JPEGs. It
+// returns nil if the image is small enough to not need a thumbnail.
+func generateThumbnail(img image.Image, format string) ([]byte, error) {
+	bounds := img.Bounds()
+	width, height, ok := thumbnailSize(bounds.Dx(), bounds.Dy(),
+		configuration.Thumbnails.MaxWidth, configuration.Thumbnails.MaxHeight)
+	if !ok {
+		return nil, nil
+	}
+	thumbnail := downscaleImage(img, width, height)
+
+	var buf bytes.Buffer
+	var err error
+	if format == "png" || format == "gif" {
+		err = png.Encode(&buf, thumbnail)
+	} else {
+		err = jpeg.Encode(&buf, thumbnail, &jpeg.Options{Quality: thumbnailJPEGQuality})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestThumbnailSize(t *testing.T) {
+	tests := []struct {
+		name                string
+		width, height       int
+		maxWidth, maxHeight int
+		expectedWidth       int
+		expectedHeight      int
+		expectedOK          bool
+	}{
+		{"landscape", 1600, 1200, 800, 600, 800, 600, true},
+		{"wide landscape", 2000, 500, 800, 600, 800, 200, true},
+		{"portrait", 1200, 1600, 800, 600, 450, 600, true},
+		{"square", 1000, 1000, 800, 600, 600, 600, true},
+		{"only width too large", 1000, 100, 800, 600, 800, 80, true},
+		{"only height too large", 100, 1000, 800, 600, 60, 600, true},
+		{"rounds down", 1001, 999, 800, 600, 601, 600, true},
+
+		{"already fits", 640, 480, 800, 600, 0, 0, false},
+		{"exactly the maximum", 800, 600, 800, 600, 0, 0, false},
+		{"tiny image", 1, 1, 800, 600, 0, 0, false},
+
+		{"extremely wide", 100000, 10, 800, 600, 800, 1, true},
+		{"extremely tall", 10, 100000, 800, 600, 1, 600, true},
+
+		{"zero width", 0, 1000, 800, 600, 0, 0, false},
+		{"negative height", 1000, -1, 800, 600, 0, 0, false},
+		{"disabled", 1600, 1200, 0, 0, 0, 0, false},
+		{"width limit disabled", 1600, 1200, 0, 600, 0, 0, false},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			width, height, ok := thumbnailSize(test.width, test.height, test.maxWidth, test.maxHeight)
+			if width != test.expectedWidth || height != test.expectedHeight || ok != test.expectedOK {
+				t.Errorf("expected %dx%d (%t), got %dx%d (%t)",
+					test.expectedWidth, test.expectedHeight, test.expectedOK, width, height, ok)
+			}
+			if ok && (width > test.maxWidth || height > test.maxHeight) {
+				t.Errorf("thumbnail %dx%d doesn't fit in %dx%d", width, height, test.maxWidth, test.maxHeight)
+			}
+		})
+	}
+}
+
+// checkerboard returns an image with alternating black and white pixels.
+func checkerboard(rect image.Rectangle) *image.Gray {
+	img := image.NewGray(rect)
+	for y := rect.Min.Y; y < rect.Max.Y; y++ {
+		for x := rect.Min.X; x < rect.Max.X; x++ {
+			if (x+y)%2 == 0 {
+				img.SetGray(x, y, color.Gray{Y: 255})
+			}
+		}
+	}
+	return img
+}
+
+func TestDownscaleImage(t *testing.T) {
+	red := image.NewRGBA(image.Rect(0, 0, 30, 20))
+	for i := 0; i < len(red.Pix); i += 4 {
+		copy(red.Pix[i:i+4], []byte{255, 0, 0, 255})
+	}
+
+	tests := []struct {
+		name     string
+		img      image.Image
+		width    int
+		height   int
+		expected color.RGBA
+	}{
+		{"rgba", red, 15, 10, color.RGBA{R: 255, A: 255}},
+		{"rgba sub-image", red.SubImage(image.Rect(10, 5, 30, 20)), 4, 3, color.RGBA{R: 255, A: 255}},
+		{"gray averages pixels", checkerboard(image.Rect(0, 0, 40, 40)), 20, 20, color.RGBA{R: 127, G: 127, B: 127, A: 255}},
+		{"offset bounds", checkerboard(image.Rect(-10, -10, 30, 30)), 10, 10, color.RGBA{R: 127, G: 127, B: 127, A: 255}},
+		{"extreme aspect ratio", red, 30, 1, color.RGBA{R: 255, A: 255}},
+		{"more rows than the source", red, 3, 40, color.RGBA{R: 255, A: 255}},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			thumbnail := downscaleImage(test.img, test.width, test.height)
+			if bounds := thumbnail.Bounds(); bounds != image.Rect(0, 0, test.width, test.height) {
+				t.Fatalf("expected bounds %dx%d, got %v", test.width, test.height, bounds)
+			}
+			for y := 0; y < test.height; y++ {
+				for x := 0; x < test.width; x++ {
+					if actual := thumbnail.RGBAAt(x, y); actual != test.expected {
+						t.Fatalf("expected pixel %d,%d to be %v, got %v", x, y, test.expected, actual)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateThumbnail(t *testing.T) {
+	previous := configuration.Thumbnails
+	configuration.Thumbnails.MaxWidth = 80
+	configuration.Thumbnails.MaxHeight = 60
+	t.Cleanup(func() { configuration.Thumbnails = previous })
+
+	tests := []struct {
+		name           string
+		img            image.Image
+		format         string
+		expectedFormat string
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{"jpeg", checkerboard(image.Rect(0, 0, 160, 90)), "jpeg", "jpeg", 80, 45},
+		{"png", checkerboard(image.Rect(0, 0, 90, 160)), "png", "png", 33, 60},
+		{"gif", checkerboard(image.Rect(0, 0, 200, 200)), "gif", "png", 60, 60},
+		{"webp", checkerboard(image.Rect(0, 0, 200, 100)), "webp", "jpeg", 80, 40},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			data, err := generateThumbnail(test.img, test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, format, err := image.DecodeConfig(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to decode thumbnail: %v", err)
+			}
+			if format != test.expectedFormat || config.Width != test.expectedWidth || config.Height != test.expectedHeight {
+				t.Errorf("expected a %dx%d %s thumbnail, got a %dx%d %s",
+					test.expectedWidth, test.expectedHeight, test.expectedFormat, config.Width, config.Height, format)
+			}
+		})
+	}
+
+	t.Run("small image", func(t *testing.T) {
+		data, err := generateThumbnail(checkerboard(image.Rect(0, 0, 80, 60)), "png")
+		if err != nil || data != nil {
+			t.Errorf("expected no thumbnail, got %d bytes (error: %v)", len(data), err)
+		}
+	})
+}
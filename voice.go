@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	"maunium.net/go/mautrix/event"
+
+	"github.com/beeper/chatwoot/media"
+)
+
+// Keys of the extensible event content of voice messages (MSC3245 and
+// MSC3246).
+const (
+	voiceKey = "org.matrix.msc3245.voice"
+	audioKey = "org.matrix.msc1767.audio"
+)
+
+// isVoiceMessage returns whether the Matrix message is a voice message.
+func isVoiceMessage(evt *event.Event, content *event.MessageEventContent) bool {
+	_, isVoice := evt.Content.Raw[voiceKey]
+	return isVoice && content.MsgType == event.MsgAudio
+}
+
+// voiceMessageDuration returns the duration of the voice message from the
+// content, or by reading the audio file if the content doesn't have it.
+func voiceMessageDuration(evt *event.Event, content *event.MessageEventContent, data []byte) time.Duration {
+	if content.Info != nil && content.Info.Duration > 0 {
+		return time.Duration(content.Info.Duration) * time.Millisecond
+	}
+	if audio, ok := evt.Content.Raw[audioKey].(map[string]any); ok {
+		if duration, ok := audio["duration"].(float64); ok && duration > 0 {
+			return time.Duration(duration) * time.Millisecond
+		}
+	}
+	if info, err := media.Parse(data); err == nil {
+		return info.Duration
+	}
+	return 0
+}
+
+// voiceMessageFilename returns a filename for the voice message with an
+// extension that matches the MIME type, since voice messages usually don't
+// have a filename of their own.
+func voiceMessageFilename(mimeType string) string {
+	baseType, _, _ := strings.Cut(mimeType, ";")
+	switch baseType {
+	case "audio/ogg", "application/ogg":
+		return "voice-message.ogg"
+	}
+	if extensions, err := mime.ExtensionsByType(baseType); err == nil && len(extensions) > 0 {
+		return "voice-message" + extensions[0]
+	}
+	return "voice-message"
+}
+
+// formatDuration formats the duration as minutes and seconds.
+func formatDuration(duration time.Duration) string {
+	seconds := int(duration.Round(time.Second).Seconds())
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/hlog"
+)
+
+var (
+	errMissingSignature   = errors.New("missing signature")
+	errInvalidSignature   = errors.New("invalid signature")
+	errStaleTimestamp     = errors.New("timestamp outside of allowed window")
+	errReplayedDelivery   = errors.New("delivery was already processed")
+	errInvalidSharedToken = errors.New("invalid shared secret token")
+)
+
+// WebhookVerifier verifies that webhook requests actually come from Chatwoot.
+//
+// If a signature secret is configured, the X-Chatwoot-Signature header must
+// contain the HMAC-SHA256 of "<timestamp>.<body>" keyed with the secret. As a
+// fallback, a shared secret token can be passed as the last path component
+// (/webhook/<token>) or in the X-Webhook-Token header.
+type WebhookVerifier struct {
+	signatureSecret []byte
+	sharedSecret    []byte
+	maxSkew         time.Duration
+
+	seenLock sync.Mutex
+	seen     map[string]time.Time
+}
+
+func NewWebhookVerifier(signatureSecret, sharedSecret string, maxSkew time.Duration) *WebhookVerifier {
+	return &WebhookVerifier{
+		signatureSecret: []byte(signatureSecret),
+		sharedSecret:    []byte(sharedSecret),
+		maxSkew:         maxSkew,
+		seen:            map[string]time.Time{},
+	}
+}
+
+func (v *WebhookVerifier) Enabled() bool {
+	return len(v.signatureSecret) > 0 || len(v.sharedSecret) > 0
+}
+
+// verifySignature checks the signature of the request and returns the
+// verified signature, which identifies the timestamp and body of the request.
+func (v *WebhookVerifier) verifySignature(r *http.Request, body []byte) (string, error) {
+	signature := r.Header.Get("X-Chatwoot-Signature")
+	timestamp := r.Header.Get("X-Chatwoot-Timestamp")
+	if signature == "" || timestamp == "" {
+		return "", errMissingSignature
+	}
+
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed timestamp", errInvalidSignature)
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > v.maxSkew || skew < -v.maxSkew {
+		return "", errStaleTimestamp
+	}
+
+	expected, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed signature", errInvalidSignature)
+	}
+	mac := hmac.New(sha256.New, v.signatureSecret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	actual := mac.Sum(nil)
+	if !hmac.Equal(actual, expected) {
+		return "", errInvalidSignature
+	}
+	return hex.EncodeToString(actual), nil
+}
+
+func (v *WebhookVerifier) verifySharedSecret(r *http.Request) error {
+	token := r.Header.Get("X-Webhook-Token")
+	if token == "" && strings.HasPrefix(r.URL.Path, "/webhook/") {
+		token = strings.TrimPrefix(r.URL.Path, "/webhook/")
+	}
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), v.sharedSecret) != 1 {
+		return errInvalidSharedToken
+	}
+	return nil
+}
+
+// checkReplay returns an error if the signature was already seen within the
+// allowed timestamp window, and otherwise marks it as seen. The signature
+// covers the timestamp and the body, so unlike the delivery ID header it can't
+// be changed to resend a request. Signatures older than the window are
+// forgotten since the timestamp check rejects them anyway.
+func (v *WebhookVerifier) checkReplay(signature string) error {
+	v.seenLock.Lock()
+	defer v.seenLock.Unlock()
+
+	now := time.Now()
+	for seenSignature, seenAt := range v.seen {
+		if now.Sub(seenAt) > 2*v.maxSkew {
+			delete(v.seen, seenSignature)
+		}
+	}
+	if _, found := v.seen[signature]; found {
+		return errReplayedDelivery
+	}
+	v.seen[signature] = now
+	return nil
+}
+
+// forgetDelivery allows the request with the signature to be delivered again.
+// This is used when handling the request failed, so that Chatwoot can retry
+// it.
+func (v *WebhookVerifier) forgetDelivery(signature string) {
+	v.seenLock.Lock()
+	defer v.seenLock.Unlock()
+	delete(v.seen, signature)
+}
+
+// verify checks that the request comes from Chatwoot. For signed requests, it
+// returns the signature, which has been marked as seen.
+func (v *WebhookVerifier) verify(r *http.Request, body []byte) (string, error) {
+	var err error
+	if len(v.signatureSecret) > 0 {
+		var signature string
+		signature, err = v.verifySignature(r, body)
+		if err == nil {
+			return signature, v.checkReplay(signature)
+		} else if !errors.Is(err, errMissingSignature) || len(v.sharedSecret) == 0 {
+			return "", err
+		}
+	}
+	if len(v.sharedSecret) > 0 {
+		return "", v.verifySharedSecret(r)
+	}
+	return "", err
+}
+
+// statusRecorder remembers the status code that the handler responded with.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(data)
+}
+
+// Middleware rejects all requests that can't be verified with a 401.
+func (v *WebhookVerifier) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !v.Enabled() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		log := hlog.FromRequest(r)
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			log.Err(err).Msg("failed to read webhook body")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		signature, err := v.verify(r, body)
+		if err != nil {
+			log.Warn().Err(err).
+				Str("remote_addr", r.RemoteAddr).
+				Str("path", r.URL.Path).
+				Str("delivery_id", r.Header.Get("X-Chatwoot-Delivery")).
+				Msg("rejecting unauthenticated webhook request")
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		// Chatwoot retries failed deliveries with the same signature, so the
+		// retries must not be rejected as replays.
+		if signature != "" && recorder.status >= 300 {
+			v.forgetDelivery(signature)
+		}
+	})
+}
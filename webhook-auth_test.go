@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSignatureSecret = "signature-secret"
+	testSharedSecret    = "shared-secret"
+)
+
+func signWebhook(secret, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "." + body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+type webhookRequest struct {
+	path       string
+	body       string
+	timestamp  time.Time
+	signature  string
+	token      string
+	deliveryID string
+}
+
+// newSignedWebhookRequest returns a request that is signed with the test
+// signature secret.
+func newSignedWebhookRequest(body string, timestamp time.Time) webhookRequest {
+	return webhookRequest{
+		path:      "/webhook",
+		body:      body,
+		timestamp: timestamp,
+		signature: signWebhook(testSignatureSecret, strconv.FormatInt(timestamp.Unix(), 10), body),
+	}
+}
+
+func (req webhookRequest) send(handler http.Handler) int {
+	r := httptest.NewRequest(http.MethodPost, req.path, strings.NewReader(req.body))
+	if !req.timestamp.IsZero() {
+		r.Header.Set("X-Chatwoot-Timestamp", strconv.FormatInt(req.timestamp.Unix(), 10))
+	}
+	if req.signature != "" {
+		r.Header.Set("X-Chatwoot-Signature", req.signature)
+	}
+	if req.token != "" {
+		r.Header.Set("X-Webhook-Token", req.token)
+	}
+	if req.deliveryID != "" {
+		r.Header.Set("X-Chatwoot-Delivery", req.deliveryID)
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+// newTestWebhookHandler returns the verification middleware around a handler
+// that responds with the given status and checks that the body can still be
+// read.
+func newTestWebhookHandler(t *testing.T, signatureSecret, sharedSecret string, status *int) http.Handler {
+	verifier := NewWebhookVerifier(signatureSecret, sharedSecret, 5*time.Minute)
+	return verifier.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := io.ReadAll(r.Body); err != nil {
+			t.Errorf("failed to read body in handler: %v", err)
+		}
+		w.WriteHeader(*status)
+	}))
+}
+
+func TestWebhookVerification(t *testing.T) {
+	now := time.Now()
+	signed := newSignedWebhookRequest(`{"event":"message_created"}`, now)
+
+	tampered := signed
+	tampered.body = `{"event":"message_updated"}`
+
+	wrongSecret := signed
+	wrongSecret.signature = signWebhook("wrong", strconv.FormatInt(now.Unix(), 10), signed.body)
+
+	malformedSignature := signed
+	malformedSignature.signature = "sha256=not-hex"
+
+	tests := []struct {
+		name            string
+		signatureSecret string
+		sharedSecret    string
+		request         webhookRequest
+		expected        int
+	}{
+		{"valid signature", testSignatureSecret, "", signed, http.StatusOK},
+		{"signature without prefix", testSignatureSecret, "", webhookRequest{
+			path:      "/webhook",
+			body:      signed.body,
+			timestamp: now,
+			signature: strings.TrimPrefix(signed.signature, "sha256="),
+		}, http.StatusOK},
+		{"tampered body", testSignatureSecret, "", tampered, http.StatusUnauthorized},
+		{"wrong secret", testSignatureSecret, "", wrongSecret, http.StatusUnauthorized},
+		{"malformed signature", testSignatureSecret, "", malformedSignature, http.StatusUnauthorized},
+		{"missing signature", testSignatureSecret, "", webhookRequest{path: "/webhook", body: signed.body}, http.StatusUnauthorized},
+		{"old timestamp", testSignatureSecret, "", newSignedWebhookRequest(signed.body, now.Add(-6*time.Minute)), http.StatusUnauthorized},
+		{"future timestamp", testSignatureSecret, "", newSignedWebhookRequest(signed.body, now.Add(6*time.Minute)), http.StatusUnauthorized},
+		{"timestamp within skew", testSignatureSecret, "", newSignedWebhookRequest(signed.body, now.Add(-4*time.Minute)), http.StatusOK},
+
+		{"shared secret header", "", testSharedSecret, webhookRequest{path: "/webhook", token: testSharedSecret}, http.StatusOK},
+		{"shared secret path", "", testSharedSecret, webhookRequest{path: "/webhook/" + testSharedSecret}, http.StatusOK},
+		{"wrong shared secret", "", testSharedSecret, webhookRequest{path: "/webhook/wrong"}, http.StatusUnauthorized},
+		{"missing shared secret", "", testSharedSecret, webhookRequest{path: "/webhook"}, http.StatusUnauthorized},
+
+		{"fallback to shared secret when unsigned", testSignatureSecret, testSharedSecret, webhookRequest{path: "/webhook", token: testSharedSecret}, http.StatusOK},
+		{"no fallback for invalid signatures", testSignatureSecret, testSharedSecret, func() webhookRequest {
+			req := tampered
+			req.token = testSharedSecret
+			return req
+		}(), http.StatusUnauthorized},
+		{"no fallback for stale timestamps", testSignatureSecret, testSharedSecret, func() webhookRequest {
+			req := newSignedWebhookRequest(signed.body, now.Add(-time.Hour))
+			req.token = testSharedSecret
+			return req
+		}(), http.StatusUnauthorized},
+
+		{"verification disabled", "", "", webhookRequest{path: "/webhook"}, http.StatusOK},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			status := http.StatusOK
+			handler := newTestWebhookHandler(t, test.signatureSecret, test.sharedSecret, &status)
+			if actual := test.request.send(handler); actual != test.expected {
+				t.Errorf("expected status %d, got %d", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestWebhookReplay(t *testing.T) {
+	t.Run("identical request", func(t *testing.T) {
+		status := http.StatusOK
+		handler := newTestWebhookHandler(t, testSignatureSecret, "", &status)
+		request := newSignedWebhookRequest(`{"event":"message_created"}`, time.Now())
+		request.deliveryID = "1"
+		if actual := request.send(handler); actual != http.StatusOK {
+			t.Fatalf("expected the first delivery to succeed, got %d", actual)
+		}
+		if actual := request.send(handler); actual != http.StatusUnauthorized {
+			t.Errorf("expected the replayed delivery to be rejected, got %d", actual)
+		}
+	})
+
+	t.Run("new delivery ID", func(t *testing.T) {
+		// The delivery ID isn't covered by the signature, so changing it must
+		// not allow replaying the request.
+		status := http.StatusOK
+		handler := newTestWebhookHandler(t, testSignatureSecret, "", &status)
+		request := newSignedWebhookRequest(`{"event":"message_created"}`, time.Now())
+		request.deliveryID = "1"
+		if actual := request.send(handler); actual != http.StatusOK {
+			t.Fatalf("expected the first delivery to succeed, got %d", actual)
+		}
+		request.deliveryID = "2"
+		if actual := request.send(handler); actual != http.StatusUnauthorized {
+			t.Errorf("expected the replayed delivery with a new delivery ID to be rejected, got %d", actual)
+		}
+	})
+
+	t.Run("different requests", func(t *testing.T) {
+		status := http.StatusOK
+		handler := newTestWebhookHandler(t, testSignatureSecret, "", &status)
+		now := time.Now()
+		for _, request := range []webhookRequest{
+			newSignedWebhookRequest(`{"event":"message_created"}`, now),
+			newSignedWebhookRequest(`{"event":"message_updated"}`, now),
+			newSignedWebhookRequest(`{"event":"message_created"}`, now.Add(-time.Second)),
+		} {
+			if actual := request.send(handler); actual != http.StatusOK {
+				t.Errorf("expected %s to succeed, got %d", request.body, actual)
+			}
+		}
+	})
+
+	t.Run("retry after failure", func(t *testing.T) {
+		status := http.StatusServiceUnavailable
+		handler := newTestWebhookHandler(t, testSignatureSecret, "", &status)
+		request := newSignedWebhookRequest(`{"event":"message_created"}`, time.Now())
+		request.deliveryID = "1"
+		if actual := request.send(handler); actual != http.StatusServiceUnavailable {
+			t.Fatalf("expected the first delivery to fail, got %d", actual)
+		}
+		status = http.StatusOK
+		if actual := request.send(handler); actual != http.StatusOK {
+			t.Fatalf("expected the retried delivery to succeed, got %d", actual)
+		}
+		if actual := request.send(handler); actual != http.StatusUnauthorized {
+			t.Errorf("expected a replay of the successful delivery to be rejected, got %d", actual)
+		}
+	})
+}